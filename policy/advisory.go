@@ -0,0 +1,141 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policy
+
+import (
+	"context"
+
+	"github.com/google/cel-policy-templates-go/policy/model"
+	"github.com/google/cel-policy-templates-go/policy/runtime"
+)
+
+// Advisory holds the decisions produced by the instances configured with an advisory
+// enforcement action.
+type Advisory struct {
+	// EnforcementAction is either model.EnforcementWarn or model.EnforcementDryRun.
+	EnforcementAction string
+	// Decisions are the decisions produced by the instances with the enforcement action.
+	Decisions []model.DecisionValue
+	// Err is the error encountered while evaluating the instances, if any.
+	Err error
+}
+
+// EvalAdvisory behaves like EvalContext, but also evaluates the instances whose enforcement action
+// is 'warn' or 'dryrun' and returns their decisions separately as advisories.
+//
+// The enforced decisions only reflect the instances whose enforcement action is 'deny', which are
+// the only instances evaluated by the other Eval methods. The decisions of the advisory instances
+// are aggregated per enforcement action and returned as one Advisory for each action with at least
+// one selected instance, 'warn' first and 'dryrun' second.
+//
+// Failures of advisory instances are reported via the Advisory and never affect the enforced
+// decisions, regardless of whether the engine is configured with ContinueOnError. The advisory
+// instances do count towards the cost of the evaluation, however, and an interrupted evaluation
+// returns no advisories.
+func (e *Engine) EvalAdvisory(ctx context.Context,
+	vars map[string]interface{},
+	selector model.DecisionSelector,
+	opts ...EvalOption) ([]model.DecisionValue, []*Advisory, error) {
+	ev, err := e.newEvaluation(ctx, selector, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	input := e.actPool.Get().(*activation)
+	input.vars = vars
+	defer e.actPool.Put(input)
+	adv := newAdvisoryEvals(ev)
+	decisions, err := e.evalInput(ev, input, adv)
+	if ev.Err() != nil {
+		return decisions, nil, err
+	}
+	return decisions, adv.results(), err
+}
+
+// advisoryActions lists the advisory enforcement actions in the order their results are reported.
+var advisoryActions = []string{model.EnforcementWarn, model.EnforcementDryRun}
+
+// advisoryEvals tracks the evaluations of the advisory instances, one per enforcement action.
+//
+// The advisory evaluations are forked from the enforced evaluation on first use, and so share its
+// context and cost budget.
+type advisoryEvals struct {
+	parent *runtime.Evaluation
+	evals  map[string]*advisoryEval
+}
+
+func newAdvisoryEvals(parent *runtime.Evaluation) *advisoryEvals {
+	return &advisoryEvals{
+		parent: parent,
+		evals:  map[string]*advisoryEval{},
+	}
+}
+
+// get returns the advisory evaluation for the enforcement action, creating it if necessary.
+func (adv *advisoryEvals) get(action string) *advisoryEval {
+	ae, found := adv.evals[action]
+	if !found {
+		ae = &advisoryEval{ev: adv.parent.Fork(adv.parent.Context())}
+		adv.evals[action] = ae
+	}
+	return ae
+}
+
+// results returns the advisories in the order of the advisoryActions.
+func (adv *advisoryEvals) results() []*Advisory {
+	var results []*Advisory
+	for _, action := range advisoryActions {
+		ae, found := adv.evals[action]
+		if !found {
+			continue
+		}
+		results = append(results, &Advisory{
+			EnforcementAction: action,
+			Decisions:         ae.ev.Decisions(),
+			Err:               ae.result(),
+		})
+	}
+	return results
+}
+
+// advisoryEval accumulates the decisions and failures of the instances with a single advisory
+// enforcement action.
+type advisoryEval struct {
+	ev   *runtime.Evaluation
+	errs runtime.EvalErrors
+	err  error
+}
+
+// fail records the failure of an advisory instance.
+func (ae *advisoryEval) fail(err error) {
+	if evalErrs, ok := err.(runtime.EvalErrors); ok {
+		ae.errs = append(ae.errs, evalErrs...)
+		return
+	}
+	if ae.err == nil {
+		ae.err = err
+	}
+}
+
+// result returns the first failure which was not an evaluation error, if any, or else the
+// evaluation errors of all of the failing instances.
+func (ae *advisoryEval) result() error {
+	if ae.err != nil {
+		return ae.err
+	}
+	if len(ae.errs) != 0 {
+		return ae.errs
+	}
+	return nil
+}
@@ -0,0 +1,380 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package audit evaluates stored resources against the policy instances configured within an
+// engine and reports the violations found.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/google/cel-policy-templates-go/policy"
+	"github.com/google/cel-policy-templates-go/policy/model"
+
+	"github.com/google/cel-go/common/types/ref"
+	"gopkg.in/yaml.v3"
+
+	structpb "google.golang.org/protobuf/types/known/structpb"
+)
+
+// AuditorOption is a functional option for configuring an Auditor.
+type AuditorOption func(*Auditor) (*Auditor, error)
+
+// ViolationDecision configures the name of the decision whose values are reported as violations.
+//
+// The default is 'policy.violation'.
+func ViolationDecision(name string) AuditorOption {
+	return func(a *Auditor) (*Auditor, error) {
+		a.decision = name
+		return a, nil
+	}
+}
+
+// EvalOptions configures the options applied to the evaluation of each resource.
+func EvalOptions(opts ...policy.EvalOption) AuditorOption {
+	return func(a *Auditor) (*Auditor, error) {
+		a.evalOpts = append(a.evalOpts, opts...)
+		return a, nil
+	}
+}
+
+// NewAuditor creates an Auditor which evaluates resources against the instances configured
+// within the engine.
+func NewAuditor(engine *policy.Engine, opts ...AuditorOption) (*Auditor, error) {
+	a := &Auditor{
+		engine:   engine,
+		decision: "policy.violation",
+		evalOpts: []policy.EvalOption{
+			policy.ContinueOnInstanceError(),
+			policy.IncludeAdvisories(),
+		},
+	}
+	var err error
+	for _, opt := range opts {
+		a, err = opt(a)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// Auditor evaluates stored resources against the policy instances configured within an engine.
+//
+// Resources are evaluated via Engine.EvalBatch, so the instances applicable to each resource are
+// determined by the engine's selectors, and the resources are evaluated concurrently when the
+// engine is configured with BatchParallelism.
+type Auditor struct {
+	engine   *policy.Engine
+	decision string
+	evalOpts []policy.EvalOption
+}
+
+// Audit evaluates each of the resources supplied by the source and returns a Report of the
+// violations found, grouped by template and instance.
+//
+// The violations of the instances whose enforcement action is 'warn' or 'dryrun' are included in
+// the report, and the enforcement action of each instance is listed with its violations.
+//
+// Resources which fail to evaluate are listed in the report along with their errors. The
+// evaluation of a resource continues past failing instances, regardless of whether the engine is
+// configured with ContinueOnError, so the violations found by the other instances are still
+// reported. An error is returned if the source fails to supply a resource or the context is done.
+func (a *Auditor) Audit(ctx context.Context, src Source) (*Report, error) {
+	inputs := &sourceInputs{src: src}
+	rb := newReportBuilder()
+	selector := func(name string) bool {
+		return name == a.decision
+	}
+	err := a.engine.EvalBatch(ctx, inputs, selector, func(res *policy.BatchResult) error {
+		rb.addResult(inputs.resourceName(res.Index), a.decision, res)
+		for _, adv := range res.Advisories {
+			rb.addAdvisory(inputs.resourceName(res.Index), a.decision, adv)
+		}
+		return nil
+	}, a.evalOpts...)
+	if err != nil {
+		return nil, err
+	}
+	if inputs.err != nil {
+		return nil, inputs.err
+	}
+	return rb.report(), nil
+}
+
+// sourceInputs adapts a Source to the policy.BatchInputs interface, recording the resource names
+// by batch index.
+type sourceInputs struct {
+	src   Source
+	err   error
+	mux   sync.Mutex
+	names []string
+}
+
+// Next implements the policy.BatchInputs interface method.
+func (si *sourceInputs) Next() (map[string]interface{}, bool) {
+	res, more, err := si.src.Next()
+	if err != nil {
+		si.err = err
+		return nil, false
+	}
+	if !more {
+		return nil, false
+	}
+	si.mux.Lock()
+	si.names = append(si.names, res.Name)
+	si.mux.Unlock()
+	return res.Input, true
+}
+
+func (si *sourceInputs) resourceName(index int) string {
+	si.mux.Lock()
+	defer si.mux.Unlock()
+	return si.names[index]
+}
+
+// Report summarizes the violations found by an audit.
+type Report struct {
+	// Resources is the number of resources audited.
+	Resources int `json:"resources" yaml:"resources"`
+
+	// Violations is the total number of violations found.
+	Violations int `json:"violations" yaml:"violations"`
+
+	// Templates lists the templates with violations, ordered by template name.
+	Templates []*TemplateReport `json:"templates" yaml:"templates"`
+
+	// Errors lists the resources which failed to evaluate, in audit order.
+	Errors []*ResourceError `json:"errors,omitempty" yaml:"errors,omitempty"`
+}
+
+// JSON renders the report as indented JSON.
+func (r *Report) JSON() ([]byte, error) {
+	return json.MarshalIndent(r, "", "  ")
+}
+
+// YAML renders the report as YAML.
+func (r *Report) YAML() ([]byte, error) {
+	return yaml.Marshal(r)
+}
+
+// TemplateReport summarizes the violations produced by the instances of a template.
+type TemplateReport struct {
+	// Template is the metadata name of the template.
+	Template string `json:"template" yaml:"template"`
+
+	// Violations is the number of violations produced by the template's instances.
+	Violations int `json:"violations" yaml:"violations"`
+
+	// Instances lists the instances with violations, ordered by namespace and name.
+	Instances []*InstanceReport `json:"instances" yaml:"instances"`
+}
+
+// InstanceReport lists the violations produced by a single instance.
+type InstanceReport struct {
+	// Namespace is the metadata namespace of the instance, if any.
+	Namespace string `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+
+	// Name is the metadata name of the instance.
+	Name string `json:"name" yaml:"name"`
+
+	// EnforcementAction is the enforcement action of the instance.
+	EnforcementAction string `json:"enforcementAction" yaml:"enforcementAction"`
+
+	// Violations lists the violations produced by the instance, in audit order.
+	Violations []*Violation `json:"violations" yaml:"violations"`
+}
+
+// Violation describes a violation produced for a resource.
+type Violation struct {
+	// Resource is the name of the offending resource.
+	Resource string `json:"resource" yaml:"resource"`
+
+	// Message is the violation message, if the violation output is a string or has a string
+	// 'message' field.
+	Message string `json:"message,omitempty" yaml:"message,omitempty"`
+
+	// Details holds the violation 'details' field, or the entire output when the output is
+	// neither a string nor an object with a 'message' field.
+	Details interface{} `json:"details,omitempty" yaml:"details,omitempty"`
+}
+
+// ResourceError describes a resource which failed to evaluate.
+type ResourceError struct {
+	// Resource is the name of the resource.
+	Resource string `json:"resource" yaml:"resource"`
+
+	// Error is the evaluation error.
+	Error string `json:"error" yaml:"error"`
+
+	// EnforcementAction is set when the error was produced by the instances with an advisory
+	// enforcement action.
+	EnforcementAction string `json:"enforcementAction,omitempty" yaml:"enforcementAction,omitempty"`
+}
+
+func newReportBuilder() *reportBuilder {
+	return &reportBuilder{
+		rpt:   &Report{},
+		tmpls: map[string]*TemplateReport{},
+		insts: map[instanceKey]*InstanceReport{},
+	}
+}
+
+type reportBuilder struct {
+	rpt   *Report
+	tmpls map[string]*TemplateReport
+	insts map[instanceKey]*InstanceReport
+}
+
+type instanceKey struct {
+	template  string
+	namespace string
+	name      string
+}
+
+// addResult records the violations and error reported for a resource.
+func (rb *reportBuilder) addResult(resource, decision string, res *policy.BatchResult) {
+	rb.rpt.Resources++
+	if res.Err != nil {
+		rb.rpt.Errors = append(rb.rpt.Errors, &ResourceError{
+			Resource: resource,
+			Error:    res.Err.Error(),
+		})
+	}
+	rb.addDecisions(resource, decision, model.EnforcementDeny, res.Decisions)
+}
+
+// addAdvisory records the violations and error reported for a resource by the instances with an
+// advisory enforcement action.
+func (rb *reportBuilder) addAdvisory(resource, decision string, adv *policy.Advisory) {
+	if adv.Err != nil {
+		rb.rpt.Errors = append(rb.rpt.Errors, &ResourceError{
+			Resource:          resource,
+			Error:             adv.Err.Error(),
+			EnforcementAction: adv.EnforcementAction,
+		})
+	}
+	rb.addDecisions(resource, decision, adv.EnforcementAction, adv.Decisions)
+}
+
+// addDecisions records the violations found within the decisions produced by the instances with
+// the given enforcement action.
+func (rb *reportBuilder) addDecisions(resource, decision, action string,
+	decisions []model.DecisionValue) {
+	for _, dec := range decisions {
+		if dec.Name() != decision {
+			continue
+		}
+		switch dv := dec.(type) {
+		case model.MultiDecisionValue:
+			srcs := dv.Sources()
+			for i, val := range dv.Values() {
+				var src *model.DecisionSource
+				if i < len(srcs) {
+					src = srcs[i]
+				}
+				rb.addViolation(resource, action, val, src)
+			}
+		case model.SingleDecisionValue:
+			rb.addViolation(resource, action, dv.Value(), dv.Source())
+		}
+	}
+}
+
+// addViolation records a violation value produced by the given source.
+func (rb *reportBuilder) addViolation(resource, action string,
+	val ref.Val, src *model.DecisionSource) {
+	key := instanceKey{}
+	if src != nil {
+		key = instanceKey{
+			template:  src.Template,
+			namespace: src.InstanceNamespace,
+			name:      src.InstanceName,
+		}
+	}
+	tmpl, found := rb.tmpls[key.template]
+	if !found {
+		tmpl = &TemplateReport{Template: key.template}
+		rb.tmpls[key.template] = tmpl
+	}
+	inst, found := rb.insts[key]
+	if !found {
+		inst = &InstanceReport{
+			Namespace:         key.namespace,
+			Name:              key.name,
+			EnforcementAction: action,
+		}
+		rb.insts[key] = inst
+		tmpl.Instances = append(tmpl.Instances, inst)
+	}
+	inst.Violations = append(inst.Violations, newViolation(resource, val))
+	tmpl.Violations++
+	rb.rpt.Violations++
+}
+
+// report returns the report with its templates and instances in sorted order.
+func (rb *reportBuilder) report() *Report {
+	rpt := rb.rpt
+	rpt.Templates = make([]*TemplateReport, 0, len(rb.tmpls))
+	for _, tmpl := range rb.tmpls {
+		sort.SliceStable(tmpl.Instances, func(i, j int) bool {
+			a, b := tmpl.Instances[i], tmpl.Instances[j]
+			if a.Namespace != b.Namespace {
+				return a.Namespace < b.Namespace
+			}
+			return a.Name < b.Name
+		})
+		rpt.Templates = append(rpt.Templates, tmpl)
+	}
+	sort.Slice(rpt.Templates, func(i, j int) bool {
+		return rpt.Templates[i].Template < rpt.Templates[j].Template
+	})
+	return rpt
+}
+
+// newViolation extracts the message and details of a violation from its output value.
+func newViolation(resource string, val ref.Val) *Violation {
+	v := &Violation{Resource: resource}
+	out := nativeValue(val)
+	switch o := out.(type) {
+	case string:
+		v.Message = o
+	case map[string]interface{}:
+		msg, isStr := o["message"].(string)
+		if !isStr {
+			v.Details = o
+			break
+		}
+		v.Message = msg
+		v.Details = o["details"]
+	default:
+		v.Details = o
+	}
+	return v
+}
+
+// nativeValue converts the CEL value into a JSON-compatible Go value.
+func nativeValue(val ref.Val) interface{} {
+	jsonVal, err := val.ConvertToNative(jsonValueType)
+	if err != nil {
+		return val.Value()
+	}
+	return jsonVal.(*structpb.Value).AsInterface()
+}
+
+var jsonValueType = reflect.TypeOf(&structpb.Value{})
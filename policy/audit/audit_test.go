@@ -0,0 +1,280 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/cel-policy-templates-go/policy"
+	"github.com/google/cel-policy-templates-go/policy/model"
+	"github.com/google/cel-policy-templates-go/policy/runtime"
+	"github.com/google/cel-policy-templates-go/test"
+
+	"github.com/google/cel-go/cel"
+	"gopkg.in/yaml.v3"
+)
+
+func TestAuditor_DirSource(t *testing.T) {
+	for _, workers := range []int{1, 4} {
+		engine, inst := newTestEngine(t, "required_labels", policy.BatchParallelism(workers))
+		err := engine.AddInstance(inst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		auditor, err := NewAuditor(engine)
+		if err != nil {
+			t.Fatal(err)
+		}
+		src, err := NewDirSource("../../test/testdata/audit/resources")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rpt, err := auditor.Audit(context.Background(), src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		missing := "missing one or more required labels"
+		invalid := "invalid values provided on one or more labels"
+		want := []*TemplateReport{
+			{
+				Template:   "required_labels",
+				Violations: 3,
+				Instances: []*InstanceReport{
+					{
+						Namespace:         "acme",
+						Name:              "prod_labels",
+						EnforcementAction: model.EnforcementDeny,
+						Violations: []*Violation{
+							{Resource: "db.json", Message: missing,
+								Details: map[string]interface{}{"data": []interface{}{"verified"}}},
+							{Resource: "db.json", Message: invalid,
+								Details: map[string]interface{}{"data": []interface{}{"env"}}},
+							{Resource: "web.yaml", Message: missing,
+								Details: map[string]interface{}{"data": []interface{}{"verified"}}},
+						},
+					},
+				},
+			},
+		}
+		if rpt.Resources != 3 || rpt.Violations != 3 {
+			t.Errorf("workers=%d: got %d resources with %d violations, wanted 3 with 3",
+				workers, rpt.Resources, rpt.Violations)
+		}
+		if !reflect.DeepEqual(rpt.Templates, want) {
+			got, _ := rpt.JSON()
+			t.Errorf("workers=%d: got report %s", workers, got)
+		}
+		// The verified label is declared as a boolean by the instance, so comparing it against
+		// the string label value fails.
+		if len(rpt.Errors) != 1 || rpt.Errors[0].Resource != "nested/cache.yml" {
+			t.Errorf("workers=%d: got errors %v, wanted an error for nested/cache.yml",
+				workers, rpt.Errors)
+		}
+	}
+}
+
+func TestAuditor_MemorySource(t *testing.T) {
+	engine, inst := newTestEngine(t, "required_labels")
+	// The staging instance is being rolled out, so its violations are recorded but not enforced.
+	actions := map[string]string{
+		"staging_labels": model.EnforcementDryRun,
+		"prod_labels":    model.EnforcementDeny,
+	}
+	for name, action := range actions {
+		named := *inst
+		named.Metadata = &model.InstanceMetadata{Namespace: "acme", Name: name}
+		named.EnforcementAction = action
+		err := engine.AddInstance(&named)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var resources []*Resource
+	for i := 0; i < 3; i++ {
+		resources = append(resources, &Resource{
+			Name: fmt.Sprintf("resource-%d", i),
+			Input: map[string]interface{}{
+				"resource.labels": map[string]string{"env": "prod", "ssh": "enabled"},
+			},
+		})
+	}
+	auditor, err := NewAuditor(engine, EvalOptions(policy.CostLimit(-1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpt, err := auditor.Audit(context.Background(), NewMemorySource(resources...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rpt.Resources != 3 || rpt.Violations != 6 || len(rpt.Errors) != 0 {
+		t.Fatalf("got report %v, wanted 3 resources with 6 violations", rpt)
+	}
+	tmpl := rpt.Templates[0]
+	if len(tmpl.Instances) != 2 ||
+		tmpl.Instances[0].Name != "prod_labels" ||
+		tmpl.Instances[1].Name != "staging_labels" {
+		t.Fatalf("got instances %v, wanted prod_labels and staging_labels", tmpl.Instances)
+	}
+	for _, ir := range tmpl.Instances {
+		if ir.EnforcementAction != actions[ir.Name] {
+			t.Errorf("instance %s: got enforcement action %s, wanted %s",
+				ir.Name, ir.EnforcementAction, actions[ir.Name])
+		}
+		var got []string
+		for _, v := range ir.Violations {
+			got = append(got, v.Resource)
+		}
+		want := []string{"resource-0", "resource-1", "resource-2"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("instance %s: got violations for %v, wanted %v", ir.Name, got, want)
+		}
+	}
+
+	// The report may be exported as JSON and YAML with equivalent content.
+	jsonOut, err := rpt.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	yamlOut, err := rpt.YAML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromJSON, fromYAML map[string]interface{}
+	if err := json.Unmarshal(jsonOut, &fromJSON); err != nil {
+		t.Fatal(err)
+	}
+	if err := yaml.Unmarshal(yamlOut, &fromYAML); err != nil {
+		t.Fatal(err)
+	}
+	if fromJSON["violations"] != float64(6) || fromYAML["violations"] != 6 {
+		t.Errorf("got json %s and yaml %s, wanted 6 violations", jsonOut, yamlOut)
+	}
+	if !strings.Contains(string(yamlOut), "message: missing one or more required labels") {
+		t.Errorf("got yaml %s, wanted violation messages", yamlOut)
+	}
+}
+
+func TestAuditor_InstanceError(t *testing.T) {
+	engine, inst := newTestEngine(t, "required_labels")
+	err := engine.AddInstance(inst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envInst, iss := engine.CompileInstance(model.StringSource(`
+apiVersion: policy.acme.co/v1
+kind: required_labels
+metadata:
+  name: env_labels
+  namespace: acme
+rules:
+  - labels:
+      env: prod
+`, "env_labels.yaml"))
+	if iss.Err() != nil {
+		t.Fatal(iss.Err())
+	}
+	err = engine.AddInstance(envInst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditor, err := NewAuditor(engine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The prod_labels instance fails to compare its boolean verified label with the string label
+	// value, but the engine is not configured with ContinueOnError, so the audit must continue
+	// past the failure to report the violation found by the env_labels instance.
+	rpt, err := auditor.Audit(context.Background(), NewMemorySource(&Resource{
+		Name: "cache",
+		Input: map[string]interface{}{
+			"resource.labels": map[string]string{
+				"env": "dev", "ssh": "enabled", "verified": "true"},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rpt.Errors) != 1 || rpt.Errors[0].Resource != "cache" {
+		t.Errorf("got errors %v, wanted an error for cache", rpt.Errors)
+	}
+	if rpt.Violations != 1 || len(rpt.Templates) != 1 ||
+		len(rpt.Templates[0].Instances) != 1 ||
+		rpt.Templates[0].Instances[0].Name != "env_labels" {
+		got, _ := rpt.JSON()
+		t.Errorf("got report %s, wanted one env_labels violation", got)
+	}
+}
+
+func TestAuditor_SourceError(t *testing.T) {
+	engine, inst := newTestEngine(t, "required_labels")
+	err := engine.AddInstance(inst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditor, err := NewAuditor(engine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = auditor.Audit(context.Background(), &errorSource{})
+	if err == nil || err.Error() != "unreadable resource" {
+		t.Errorf("got error %v, wanted unreadable resource", err)
+	}
+}
+
+type errorSource struct{}
+
+func (errorSource) Next() (*Resource, bool, error) {
+	return nil, false, fmt.Errorf("unreadable resource")
+}
+
+// newTestEngine configures an engine with the template for the given policy, and returns the
+// compiled, but not yet added, policy instance.
+func newTestEngine(tb testing.TB,
+	name string, opts ...policy.EngineOption) (*policy.Engine, *model.Instance) {
+	tb.Helper()
+	env, _ := cel.NewEnv(test.Decls)
+	engOpts := []policy.EngineOption{
+		policy.StandardExprEnv(env),
+		policy.RuntimeTemplateOptions(
+			runtime.Functions(test.Funcs...),
+			runtime.NewCollectAggregator("policy.violation"),
+		),
+	}
+	engine, err := policy.NewEngine(append(engOpts, opts...)...)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tr := test.NewReader("../../test/testdata")
+	tmplSrc, _ := tr.Read(fmt.Sprintf("../../test/testdata/%s/template.yaml", name))
+	tmpl, iss := engine.CompileTemplate(tmplSrc)
+	if iss.Err() != nil {
+		tb.Fatal(iss.Err())
+	}
+	err = engine.SetTemplate(tmpl.Metadata.Name, tmpl)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	instSrc, _ := tr.Read(fmt.Sprintf("../../test/testdata/%s/instance.yaml", name))
+	inst, iss := engine.CompileInstance(instSrc)
+	if iss.Err() != nil {
+		tb.Fatal(iss.Err())
+	}
+	return engine, inst
+}
@@ -0,0 +1,163 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Resource is a stored resource to audit.
+type Resource struct {
+	// Name identifies the resource within the audit report.
+	Name string
+
+	// Input holds the variables, such as 'resource.name' and 'resource.labels', against which the
+	// resource is evaluated.
+	Input map[string]interface{}
+}
+
+// Source supplies the resources to audit.
+type Source interface {
+	// Next returns the next resource, or false when there are no more resources.
+	//
+	// An error is returned if the next resource could not be read, in which case the audit stops.
+	Next() (*Resource, bool, error)
+}
+
+// NewMemorySource returns a Source which supplies the given resources in order.
+func NewMemorySource(resources ...*Resource) Source {
+	return &memorySource{resources: resources}
+}
+
+type memorySource struct {
+	resources []*Resource
+	next      int
+}
+
+// Next implements the Source interface method.
+func (src *memorySource) Next() (*Resource, bool, error) {
+	if src.next >= len(src.resources) {
+		return nil, false, nil
+	}
+	res := src.resources[src.next]
+	src.next++
+	return res, true, nil
+}
+
+// NewDirSource returns a Source which supplies the resources stored as JSON or YAML files within
+// the directory or any of its subdirectories, in lexical order of their paths.
+//
+// Each file with a '.json', '.yaml', or '.yml' extension holds a single resource whose top-level
+// keys are the names of the input variables. The resource is named by its path relative to the
+// directory. Files with other extensions are ignored.
+func NewDirSource(dir string) (Source, error) {
+	var paths []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".json", ".yaml", ".yml":
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &dirSource{dir: dir, paths: paths}, nil
+}
+
+type dirSource struct {
+	dir   string
+	paths []string
+	next  int
+}
+
+// Next implements the Source interface method.
+func (src *dirSource) Next() (*Resource, bool, error) {
+	if src.next >= len(src.paths) {
+		return nil, false, nil
+	}
+	path := src.paths[src.next]
+	src.next++
+	name, err := filepath.Rel(src.dir, path)
+	if err != nil {
+		return nil, false, err
+	}
+	name = filepath.ToSlash(name)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false, err
+	}
+	var input map[string]interface{}
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		input, err = decodeJSON(data)
+	} else {
+		err = yaml.Unmarshal(data, &input)
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid resource %s: %v", name, err)
+	}
+	return &Resource{Name: name, Input: input}, true, nil
+}
+
+// decodeJSON decodes a JSON object, preserving integral numbers as int64 values so that they
+// compare equal to CEL int literals.
+func decodeJSON(data []byte) (map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var input map[string]interface{}
+	err := dec.Decode(&input)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range input {
+		input[k] = normalizeJSON(v)
+	}
+	return input, nil
+}
+
+// normalizeJSON converts the json.Number values within a decoded JSON value to int64 or float64.
+func normalizeJSON(val interface{}) interface{} {
+	switch v := val.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, elem := range v {
+			v[k] = normalizeJSON(elem)
+		}
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = normalizeJSON(elem)
+		}
+	}
+	return val
+}
@@ -0,0 +1,212 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policy
+
+import (
+	"context"
+	"sync"
+
+	"github.com/google/cel-policy-templates-go/policy/model"
+)
+
+// BatchInputs supplies the inputs of a batch evaluation.
+//
+// Next is only called from a single goroutine at a time.
+type BatchInputs interface {
+	// Next returns the next input to evaluate, or false when there are no more inputs.
+	Next() (map[string]interface{}, bool)
+}
+
+// SliceInputs returns BatchInputs which supply each of the given inputs in order.
+func SliceInputs(inputs []map[string]interface{}) BatchInputs {
+	return &sliceInputs{inputs: inputs}
+}
+
+type sliceInputs struct {
+	inputs []map[string]interface{}
+	next   int
+}
+
+// Next implements the BatchInputs interface method.
+func (si *sliceInputs) Next() (map[string]interface{}, bool) {
+	if si.next >= len(si.inputs) {
+		return nil, false
+	}
+	input := si.inputs[si.next]
+	si.next++
+	return input, true
+}
+
+// BatchResult describes the outcome of evaluating a single input within a batch evaluation.
+type BatchResult struct {
+	// Index is the position of the input within the batch.
+	Index int
+	// Input is the input which was evaluated.
+	Input map[string]interface{}
+	// Decisions are the decisions produced for the input.
+	Decisions []model.DecisionValue
+	// Advisories are the decisions produced by the advisory instances for the input, when the
+	// batch is evaluated with the IncludeAdvisories option.
+	Advisories []*Advisory
+	// Err is the error encountered while evaluating the input, if any.
+	Err error
+}
+
+// BatchHandler receives the result of each input within a batch evaluation.
+//
+// Returning an error stops the batch evaluation, and the error is returned from EvalBatch.
+type BatchHandler func(*BatchResult) error
+
+// EvalBatch evaluates each of the inputs against the configured instances and calls the handler
+// with the result of each input, in input order.
+//
+// Each input is evaluated as though by EvalContext, or by EvalAdvisory when the IncludeAdvisories
+// option is given, with the decisions, advisories, and error of the input reported via its
+// BatchResult rather than stopping the batch. Up to BatchParallelism inputs are evaluated
+// concurrently, while the handler is only called from a single goroutine at a time.
+//
+// Templates and instances may be changed while a batch is in progress, in which case the inputs
+// evaluated after the change observe the new configuration.
+//
+// The batch stops early when the context is cancelled or its deadline is exceeded, in which case
+// the context error is returned, or when the handler returns an error.
+func (e *Engine) EvalBatch(ctx context.Context,
+	inputs BatchInputs,
+	selector model.DecisionSelector,
+	handler BatchHandler,
+	opts ...EvalOption) error {
+	if e.batchWkrs > 1 {
+		return e.evalBatchParallel(ctx, inputs, selector, handler, opts)
+	}
+	input := e.actPool.Get().(*activation)
+	defer e.actPool.Put(input)
+	for i := 0; ; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		vars, more := inputs.Next()
+		if !more {
+			return nil
+		}
+		res := e.evalBatchInput(ctx, selector, opts, input, i, vars)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := handler(res); err != nil {
+			return err
+		}
+	}
+}
+
+// evalBatchParallel evaluates the batch inputs concurrently using a bounded set of workers.
+//
+// Inputs are read by a single dispatcher and queued for the workers, while the jobs are also
+// tracked in input order so that results are reported in the same order as sequential
+// evaluation. The number of inputs in flight is bounded by a small multiple of the worker count.
+func (e *Engine) evalBatchParallel(ctx context.Context,
+	inputs BatchInputs,
+	selector model.DecisionSelector,
+	handler BatchHandler,
+	opts []EvalOption) error {
+	workCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	workers := e.batchWkrs
+	queue := make(chan *batchJob, workers)
+	pending := make(chan *batchJob, 2*workers)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			input := e.actPool.Get().(*activation)
+			defer e.actPool.Put(input)
+			for job := range queue {
+				job.res = e.evalBatchInput(workCtx, selector, opts, input, job.index, job.vars)
+				close(job.done)
+			}
+		}()
+	}
+	go func() {
+		defer close(queue)
+		defer close(pending)
+		for i := 0; workCtx.Err() == nil; i++ {
+			vars, more := inputs.Next()
+			if !more {
+				return
+			}
+			job := &batchJob{index: i, vars: vars, done: make(chan struct{})}
+			select {
+			case pending <- job:
+				queue <- job
+			case <-workCtx.Done():
+				return
+			}
+		}
+	}()
+	// Report the results in input order. Once the batch has been stopped, the remaining jobs are
+	// drained so that the dispatcher and workers are able to exit.
+	var err error
+	for job := range pending {
+		<-job.done
+		if err != nil {
+			continue
+		}
+		if err = ctx.Err(); err == nil {
+			err = handler(job.res)
+		}
+		if err != nil {
+			cancel()
+		}
+	}
+	wg.Wait()
+	if err == nil {
+		err = ctx.Err()
+	}
+	return err
+}
+
+// evalBatchInput evaluates a single batch input using the given input activation.
+func (e *Engine) evalBatchInput(ctx context.Context,
+	selector model.DecisionSelector,
+	opts []EvalOption,
+	input *activation,
+	index int,
+	vars map[string]interface{}) *BatchResult {
+	res := &BatchResult{Index: index, Input: vars}
+	ev, err := e.newEvaluation(ctx, selector, opts...)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	input.vars = vars
+	var adv *advisoryEvals
+	if ev.IncludeAdvisories() {
+		adv = newAdvisoryEvals(ev)
+	}
+	res.Decisions, res.Err = e.evalInput(ev, input, adv)
+	if adv != nil && ev.Err() == nil {
+		res.Advisories = adv.results()
+	}
+	input.vars = nil
+	return res
+}
+
+// batchJob describes the evaluation of a single batch input by a batch evaluation worker.
+type batchJob struct {
+	index int
+	vars  map[string]interface{}
+	res   *BatchResult
+	done  chan struct{}
+}
@@ -157,6 +157,9 @@ func (c *Compiler) newDynCompiler(src *model.Source,
 	}
 }
 
+// nowVar is the name of the variable which exposes the evaluation time to template expressions.
+const nowVar = "now"
+
 type envCompiler struct {
 	*dynCompiler
 	dyn *model.DynValue
@@ -173,6 +176,11 @@ func (ec *envCompiler) compile() (*model.Env, *cel.Issues) {
 		// Compile the variables
 		varMap := ec.mapValue(vars.Ref)
 		for _, f := range varMap.Fields {
+			if f.Name == nowVar {
+				ec.reportErrorAtID(f.ID,
+					"variable '%s' is reserved for the evaluation time and must be renamed", nowVar)
+				continue
+			}
 			ec.compileVar(cenv, f.Name, f.Ref)
 		}
 	}
@@ -292,6 +300,9 @@ func (ic *instanceCompiler) compile() (*model.Instance, *cel.Issues) {
 	cinst.APIVersion = ic.mapFieldStringValueOrEmpty(ic.dyn, "apiVersion")
 	cinst.Description = ic.mapFieldStringValueOrEmpty(ic.dyn, "description")
 	cinst.Kind = ic.mapFieldStringValueOrEmpty(ic.dyn, "kind")
+	if action := ic.mapFieldStringValueOrEmpty(ic.dyn, "enforcementAction"); action != "" {
+		cinst.EnforcementAction = action
+	}
 
 	m := ic.mapValue(ic.dyn)
 	meta, found := m.GetField("metadata")
@@ -355,6 +366,15 @@ func (ic *instanceCompiler) compileMetadata(dyn *model.DynValue,
 	cmeta.Name = ic.mapFieldStringValueOrEmpty(dyn, "name")
 	cmeta.UID = ic.mapFieldStringValueOrEmpty(dyn, "uid")
 	cmeta.Namespace = ic.mapFieldStringValueOrEmpty(dyn, "namespace")
+	cmeta.NotBefore = ic.mapFieldTimeValueOrZero(dyn, "notBefore")
+	cmeta.NotAfter = ic.mapFieldTimeValueOrZero(dyn, "notAfter")
+	if !cmeta.NotBefore.IsZero() && !cmeta.NotAfter.IsZero() &&
+		cmeta.NotAfter.Before(cmeta.NotBefore) {
+		notAfter, _ := ic.mapValue(dyn).GetField("notAfter")
+		ic.reportErrorAtID(notAfter.ID,
+			"notAfter must not be before notBefore: notBefore=%s, notAfter=%s",
+			cmeta.NotBefore.Format(time.RFC3339), cmeta.NotAfter.Format(time.RFC3339))
+	}
 }
 
 func (ic *instanceCompiler) compileSelectors(dyn *model.DynValue,
@@ -425,6 +445,10 @@ func (tc *templateCompiler) compile() (*model.Template, *cel.Issues) {
 			tc.reportError(err.Error())
 		}
 	}
+	decs, found := m.GetField("decisions")
+	if found {
+		tc.compileDecisionDecls(decs.Ref, ctmpl)
+	}
 	val, found := m.GetField("validator")
 	if found {
 		tc.compileValidator(val.Ref, ctmpl)
@@ -453,6 +477,67 @@ func (tc *templateCompiler) compileMetadata(dyn *model.DynValue, cmeta *model.Te
 	}
 }
 
+func (tc *templateCompiler) compileDecisionDecls(dyn *model.DynValue, ctmpl *model.Template) {
+	decs := tc.mapValue(dyn)
+	for _, d := range decs.Fields {
+		decl := model.NewDecisionDecl(d.Ref.ID, d.Name)
+		dec := tc.mapValue(d.Ref)
+		schemaDef, found := dec.GetField("schema")
+		if found {
+			schema := model.NewOpenAPISchema()
+			tc.compileOpenAPISchema(schemaDef.Ref, schema, false)
+			decl.Type = schema.DeclType()
+		}
+		agg, found := dec.GetField("aggregate")
+		if found {
+			decl.Aggregate = tc.mapFieldStringValueOrEmpty(d.Ref, "aggregate")
+			tc.checkAggregateType(agg.Ref.ID, decl)
+		}
+		_, found = dec.GetField("finalize")
+		if found {
+			decl.Finalize = tc.mapFieldStringValueOrEmpty(d.Ref, "finalize")
+		}
+		ctmpl.Decisions = append(ctmpl.Decisions, decl)
+	}
+}
+
+// checkAggregateType reports an error if the declared decision type cannot be combined using the
+// declared aggregation strategy.
+func (tc *templateCompiler) checkAggregateType(id int64, decl *model.DecisionDecl) {
+	t := decl.Type
+	if t == model.AnyType {
+		return
+	}
+	field := ""
+	switch decl.Aggregate {
+	case model.AggregateAnd, model.AggregateOr:
+		if t != model.BoolType {
+			tc.reportErrorAtID(id, "'%s' aggregation expects bool output, found: %s",
+				decl.Aggregate, checker.FormatCheckedType(t.ExprType()))
+		}
+		return
+	case model.AggregateMin, model.AggregateMax, model.AggregateSum:
+		if t != model.IntType && t != model.UintType && t != model.DoubleType {
+			tc.reportErrorAtID(id, "'%s' aggregation expects numeric output, found: %s",
+				decl.Aggregate, checker.FormatCheckedType(t.ExprType()))
+		}
+		return
+	case model.AggregateDenyOverrides, model.AggregatePermitOverrides:
+		field = "effect"
+	case model.AggregatePriority:
+		field = "priority"
+	default:
+		return
+	}
+	if t.IsMap() {
+		return
+	}
+	if _, found := t.FindField(field); !t.IsObject() || (len(t.Fields) != 0 && !found) {
+		tc.reportErrorAtID(id, "'%s' aggregation expects output field: %s",
+			decl.Aggregate, field)
+	}
+}
+
 func (tc *templateCompiler) compileValidator(dyn *model.DynValue, ctmpl *model.Template) {
 	val := tc.mapValue(dyn)
 	if len(val.Fields) == 0 {
@@ -555,7 +640,7 @@ func (tc *templateCompiler) compileEvaluator(dyn *model.DynValue, ctmpl *model.T
 	}
 	prods, found := eval.GetField("productions")
 	if found {
-		tc.compileEvaluatorOutputDecisions(prods.Ref, productionsEnv, evaluator)
+		tc.compileEvaluatorOutputDecisions(prods.Ref, productionsEnv, evaluator, ctmpl)
 	} else {
 		tc.reportErrorAtID(dyn.ID, "evaluator missing productions field")
 	}
@@ -563,7 +648,7 @@ func (tc *templateCompiler) compileEvaluator(dyn *model.DynValue, ctmpl *model.T
 }
 
 func (tc *templateCompiler) compileEvaluatorOutputDecisions(
-	prods *model.DynValue, env *cel.Env, ceval *model.Evaluator) {
+	prods *model.DynValue, env *cel.Env, ceval *model.Evaluator, ctmpl *model.Template) {
 	productions := tc.listValue(prods)
 	if len(productions.Entries) > tc.limits.EvaluatorProductionLimit {
 		reportID := productions.Entries[tc.limits.EvaluatorProductionLimit].ID
@@ -582,7 +667,7 @@ func (tc *templateCompiler) compileEvaluatorOutputDecisions(
 				checker.FormatCheckedType(matchAst.ResultType()))
 		}
 		rule := model.NewProduction(match.Ref.ID, matchAst)
-		outDec, decFound := tc.compileOutputDecision(p, env)
+		outDec, decFound := tc.compileOutputDecision(p, env, ctmpl)
 		if decFound && outDec != nil {
 			rule.Decisions = append(rule.Decisions, outDec)
 		}
@@ -600,7 +685,7 @@ func (tc *templateCompiler) compileEvaluatorOutputDecisions(
 					tc.limits.EvaluatorDecisionLimit, len(decsList.Entries))
 			}
 			for _, elem := range decsList.Entries {
-				outDec, found := tc.compileOutputDecision(elem, env)
+				outDec, found := tc.compileOutputDecision(elem, env, ctmpl)
 				if found && outDec != nil {
 					rule.Decisions = append(rule.Decisions, outDec)
 				}
@@ -613,10 +698,11 @@ func (tc *templateCompiler) compileEvaluatorOutputDecisions(
 
 func (tc *templateCompiler) compileOutputDecision(
 	dyn *model.DynValue,
-	env *cel.Env) (*model.Decision, bool) {
+	env *cel.Env,
+	ctmpl *model.Template) (*model.Decision, bool) {
 	prod := tc.mapValue(dyn)
 	dec, decFound := prod.GetField("decision")
-	ref, refFound := prod.GetField("reference")
+	ref, refFound := prod.GetField("decisionRef")
 	out, outFound := prod.GetField("output")
 	if !decFound && !refFound && !outFound {
 		return nil, false
@@ -629,21 +715,122 @@ func (tc *templateCompiler) compileOutputDecision(
 	if refFound {
 		if decFound {
 			tc.reportErrorAtID(dyn.ID,
-				"only one of 'decision' or 'reference' may be specified.")
+				"only one of 'decision' or 'decisionRef' may be specified.")
+		}
+		refAst := tc.compileExpr(ref.Ref, env, true)
+		if refAst != nil &&
+			!proto.Equal(refAst.ResultType(), decls.String) &&
+			!proto.Equal(refAst.ResultType(), decls.Dyn) {
+			tc.reportErrorAtID(ref.Ref.ID,
+				"expected string decisionRef result, found: %s",
+				checker.FormatCheckedType(refAst.ResultType()))
 		}
-		outDec.Reference = tc.compileExpr(ref.Ref, env, true)
+		outDec.Reference = refAst
 	}
 	if !decFound && !refFound {
 		tc.reportErrorAtID(dyn.ID,
-			"one of 'decision' or 'reference' must be specified")
+			"one of 'decision' or 'decisionRef' must be specified")
+	}
+	var decl *model.DecisionDecl
+	if len(ctmpl.Decisions) != 0 {
+		// References to constant decision names are checked in the same way as decisions, while
+		// the outputs of computed references are checked during evaluation.
+		declName, declID := outDec.Name, int64(0)
+		switch {
+		case decFound:
+			declID = dec.Ref.ID
+		case outDec.Reference != nil:
+			if name, isConst := constString(outDec.Reference); isConst {
+				declName, declID = name, ref.Ref.ID
+			}
+		}
+		if declID != 0 {
+			var declFound bool
+			decl, declFound = ctmpl.FindDecisionDecl(declName)
+			if !declFound {
+				tc.reportErrorAtID(declID, "undeclared decision: %s", declName)
+			}
+		}
 	}
 	if outFound {
 		outDec.Output = tc.compileExpr(out.Ref, env, false)
+		if outDec.Output != nil && decl != nil {
+			ce, _ := cel.AstToCheckedExpr(outDec.Output)
+			tc.checkOutputType(out.Ref.ID, decl.Name, ce, ce.GetExpr(), decl.Type)
+		}
 	}
 	// otherwise, output is not specified and should result in an error from schema checking.
 	return outDec, true
 }
 
+// checkOutputType reports an error if the type of the output expression is not assignable to the
+// declared decision type.
+//
+// List and map literals are checked element by element, and map literals declared as object
+// outputs are checked field by field.
+func (tc *templateCompiler) checkOutputType(id int64,
+	name string,
+	ce *exprpb.CheckedExpr,
+	e *exprpb.Expr,
+	t *model.DeclType) {
+	valType := ce.GetTypeMap()[e.GetId()]
+	switch {
+	case t.IsObject():
+		obj := e.GetStructExpr()
+		if obj == nil || obj.GetMessageName() != "" || len(t.Fields) == 0 {
+			break
+		}
+		fields := map[string]struct{}{}
+		for _, entry := range obj.GetEntries() {
+			keyConst := entry.GetMapKey().GetConstExpr()
+			key, isStr := keyConst.GetConstantKind().(*exprpb.Constant_StringValue)
+			if !isStr {
+				// Computed keys cannot be checked against the declared fields.
+				return
+			}
+			field, found := t.FindField(key.StringValue)
+			if !found {
+				tc.reportErrorAtID(id, "undeclared field for decision %s output: %s",
+					name, key.StringValue)
+				continue
+			}
+			fields[key.StringValue] = struct{}{}
+			tc.checkOutputType(id, name, ce, entry.GetValue(), field.Type)
+		}
+		var missing []string
+		for _, f := range t.Fields {
+			if _, found := fields[f.Name]; f.Required && !found {
+				missing = append(missing, f.Name)
+			}
+		}
+		sort.Strings(missing)
+		for _, f := range missing {
+			tc.reportErrorAtID(id, "missing required field for decision %s output: %s",
+				name, f)
+		}
+		return
+	case t.IsList():
+		if l := e.GetListExpr(); l != nil {
+			for _, elem := range l.GetElements() {
+				tc.checkOutputType(id, name, ce, elem, t.ElemType)
+			}
+			return
+		}
+	case t.IsMap():
+		if m := e.GetStructExpr(); m != nil && m.GetMessageName() == "" {
+			for _, entry := range m.GetEntries() {
+				tc.checkOutputType(id, name, ce, entry.GetMapKey(), t.KeyType)
+				tc.checkOutputType(id, name, ce, entry.GetValue(), t.ElemType)
+			}
+			return
+		}
+	}
+	if !assignableToExprType(valType, t) {
+		tc.reportErrorAtID(id, "expected %s output for decision %s, found: %s",
+			checker.FormatCheckedType(t.ExprType()), name, checker.FormatCheckedType(valType))
+	}
+}
+
 func (tc *templateCompiler) buildProductionsEnv(dyn *model.DynValue,
 	ctmpl *model.Template, termLimit int) (*model.Evaluator, *cel.Env) {
 	eval := tc.mapValue(dyn)
@@ -652,8 +839,11 @@ func (tc *templateCompiler) buildProductionsEnv(dyn *model.DynValue,
 	env, err := tc.newEnv(evaluator.Environment, ctmpl)
 	if err != nil {
 		// report any environment creation errors.
-		envName, _ := eval.GetField("environment")
-		tc.reportErrorAtID(envName.Ref.ID, err.Error())
+		id := dyn.ID
+		if envName, found := eval.GetField("environment"); found {
+			id = envName.Ref.ID
+		}
+		tc.reportErrorAtID(id, err.Error())
 		return nil, nil
 	}
 	ranges, found := eval.GetField("ranges")
@@ -917,10 +1107,20 @@ func (tc *templateCompiler) newEnv(name string, ctmpl *model.Template) (*cel.Env
 	if !found {
 		return nil, fmt.Errorf("no such environment: %s", name)
 	}
+	// Environments compiled via CompileEnv never declare the reserved variable, but environments
+	// may also be constructed directly.
+	if mdlEnv, found := tc.reg.FindEnv(name); found {
+		if _, found := mdlEnv.FindVar(nowVar); found {
+			return nil, fmt.Errorf(
+				"environment %s declares variable '%s', which is reserved for the evaluation time",
+				name, nowVar)
+		}
+	}
 	metadataOpt :=
 		cel.Declarations(
 			decls.NewVar("template", decls.NewMapType(decls.String, decls.String)),
 			decls.NewVar("instance", decls.NewMapType(decls.String, decls.String)),
+			decls.NewVar(nowVar, decls.Timestamp),
 		)
 	env, err := env.Extend(metadataOpt)
 	if err != nil {
@@ -1005,6 +1205,18 @@ func (dc *dynCompiler) mapFieldStringValueOrEmpty(dyn *model.DynValue,
 	}
 }
 
+func (dc *dynCompiler) mapFieldTimeValueOrZero(dyn *model.DynValue,
+	fieldName string) time.Time {
+	m := dc.mapValue(dyn)
+	field, found := m.GetField(fieldName)
+	if !found {
+		return time.Time{}
+	}
+	// Values which are not timestamps have already been reported by the schema checking step.
+	t, _ := field.Ref.Value.(time.Time)
+	return t
+}
+
 func (dc *dynCompiler) checkSchema(dyn *model.DynValue, schema *model.OpenAPISchema) {
 	schema = dc.resolveSchemaRef(dyn, schema)
 	schemaType := schema.DeclType()
@@ -1391,6 +1603,48 @@ func assignableToType(valType, schemaType *model.DeclType) bool {
 	return false
 }
 
+// assignableToExprType returns whether values of the checked CEL type may be assigned to the
+// declared type. Dynamic values are assumed to be assignable, and maps with string keys may be
+// assigned to object types.
+func assignableToExprType(valType *exprpb.Type, t *model.DeclType) bool {
+	switch valType.GetTypeKind().(type) {
+	case nil, *exprpb.Type_Dyn, *exprpb.Type_Error:
+		return true
+	}
+	if t == model.AnyType || t == model.DynType {
+		return true
+	}
+	switch {
+	case t.IsObject():
+		if m := valType.GetMapType(); m != nil {
+			return assignableToExprType(m.GetKeyType(), model.StringType)
+		}
+		return valType.GetMessageType() == t.TypeName()
+	case t.IsList():
+		l := valType.GetListType()
+		return l != nil && assignableToExprType(l.GetElemType(), t.ElemType)
+	case t.IsMap():
+		m := valType.GetMapType()
+		return m != nil &&
+			assignableToExprType(m.GetKeyType(), t.KeyType) &&
+			assignableToExprType(m.GetValueType(), t.ElemType)
+	}
+	return proto.Equal(valType, t.ExprType())
+}
+
+// constString returns the value of an expression which is a string literal.
+func constString(ast *cel.Ast) (string, bool) {
+	ce, err := cel.AstToCheckedExpr(ast)
+	if err != nil {
+		return "", false
+	}
+	str, isStr := ce.GetExpr().GetConstExpr().GetConstantKind().(*exprpb.Constant_StringValue)
+	if !isStr {
+		return "", false
+	}
+	return str.StringValue, true
+}
+
 func getVars(ast *cel.Ast) []string {
 	ce, _ := cel.AstToCheckedExpr(ast)
 	refMap := ce.GetReferenceMap()
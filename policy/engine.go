@@ -16,8 +16,12 @@
 package policy
 
 import (
+	"context"
 	"fmt"
+	"reflect"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/google/cel-policy-templates-go/policy/compiler"
 	"github.com/google/cel-policy-templates-go/policy/limits"
@@ -30,14 +34,29 @@ import (
 )
 
 // Engine evaluates context against policy instances to produce decisions.
+//
+// Engine instances are concurrency-safe. Templates and instances may be added, replaced, or
+// removed while evaluations are in progress. Each evaluation observes the set of templates and
+// instances configured at the time the evaluation starts, and mutations wait for in-flight
+// evaluations to complete before being applied.
 type Engine struct {
 	*model.Registry
 	rwMux     sync.RWMutex
 	evalOpts  []cel.ProgramOption
 	rtOpts    []runtime.TemplateOption
+	tmplOpts  map[string][]runtime.TemplateOption
 	selectors []Selector
+	selTypes  map[reflect.Type]struct{}
 	limits    *limits.Limits
 	instances map[string][]*model.Instance
+	kinds     []string
+	indexes   map[string]*selectorIndex
+	lblsPath  string
+	workers   int
+	partial   bool
+	contOnErr bool
+	batchWkrs int
+	clock     func() time.Time
 	runtimes  map[string]*runtime.Template
 	actPool   *activationPool
 }
@@ -53,9 +72,11 @@ func NewEngine(opts ...EngineOption) (*Engine, error) {
 		Registry:  model.NewRegistry(stdEnv),
 		evalOpts:  []cel.ProgramOption{},
 		rtOpts:    []runtime.TemplateOption{},
+		tmplOpts:  map[string][]runtime.TemplateOption{},
 		selectors: []Selector{},
 		limits:    limits.NewLimits(),
 		instances: map[string][]*model.Instance{},
+		clock:     time.Now,
 		runtimes:  map[string]*runtime.Template{},
 		actPool:   newActivationPool(),
 	}
@@ -73,59 +94,313 @@ func NewEngine(opts ...EngineOption) (*Engine, error) {
 //
 // Which decisions are produced depends on the active set of policy instances and whether any rules
 // within these policies apply to the context.
+//
+// Evaluation order is deterministic: instances are evaluated in order of their template name,
+// then by instance metadata namespace and name, and rules are evaluated in the order in which
+// they are declared within the instance. Decisions are returned in evaluation order, so two
+// evaluations of the same input against the same policy set produce the same output.
+//
+// Evaluation errors are reported as a runtime.EvalErrors value which lists every failing term,
+// match, and output of the failing instance, or of all failing instances when the engine is
+// configured with the ContinueOnError option.
+//
+// Only the instances whose enforcement action is 'deny' are evaluated. The decisions of the
+// instances whose enforcement action is 'warn' or 'dryrun' are available via EvalAdvisory.
+// Instances whose 'notBefore' or 'notAfter' metadata exclude the evaluation time, as given by
+// the engine's Clock, are skipped.
 func (e *Engine) EvalAll(vars map[string]interface{}) ([]model.DecisionValue, error) {
-	return e.evalInternal(vars, nil)
+	return e.EvalContext(context.Background(), vars, nil)
 }
 
 // Eval accepts an input context and produces a set of decisions as output.
 //
 // Which decisions are produced depends on the active set of policy instances and whether any rules
-// within these policies apply to the context.
+// within these policies apply to the context. The decisions are ordered as described in EvalAll.
+//
+// As with EvalAll, only the instances whose enforcement action is 'deny' are evaluated. The
+// decisions of the instances whose enforcement action is 'warn' or 'dryrun' are excluded, and
+// are available via EvalAdvisory.
 func (e *Engine) Eval(vars map[string]interface{},
 	selector model.DecisionSelector) ([]model.DecisionValue, error) {
-	return e.evalInternal(vars, selector)
+	return e.EvalContext(context.Background(), vars, selector)
+}
+
+// EvalContext accepts a context and an input context and produces a set of decisions as output.
+//
+// The evaluation stops early when the context is cancelled or its deadline is exceeded. In this
+// case, the context error (context.Canceled or context.DeadlineExceeded) is returned along with
+// the decisions which had been finalized before the evaluation was interrupted.
+//
+// Evaluation is interrupted in the same manner with a *runtime.CostLimitError when the cost of
+// the evaluation exceeds the EvaluationCostLimit, which may be overridden for the call using the
+// CostLimit option.
+//
+// Instances whose enforcement action is 'warn' or 'dryrun' are excluded, as described in Eval.
+func (e *Engine) EvalContext(ctx context.Context,
+	vars map[string]interface{},
+	selector model.DecisionSelector,
+	opts ...EvalOption) ([]model.DecisionValue, error) {
+	ev, err := e.newEvaluation(ctx, selector, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return e.evalInternal(ev, vars)
+}
+
+// EvalWithTrace behaves like EvalContext, but also returns a trace which explains how the
+// decisions were produced.
+//
+// The trace records, for each instance and rule evaluated, the range bindings, the term values
+// computed, the result of each production match, and the decisions emitted. The trace may be
+// inspected as structured data or rendered as text via its String method.
+//
+// Tracing is considerably more expensive than regular evaluation and is intended for debugging.
+func (e *Engine) EvalWithTrace(ctx context.Context,
+	vars map[string]interface{},
+	selector model.DecisionSelector,
+	opts ...EvalOption) ([]model.DecisionValue, *runtime.Trace, error) {
+	ev, err := e.newEvaluation(ctx, selector, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	ev.EnableTrace()
+	decisions, err := e.evalInternal(ev, vars)
+	return decisions, ev.Trace(), err
+}
+
+// EvalPartial accepts a context, an input context, and a set of patterns describing the input
+// attributes which are unknown, and produces a set of decisions along with the residuals which
+// explain the decision contributions that depend on the unknown attributes.
+//
+// Decisions which depend on unknown attributes contain types.Unknown values and are not final.
+// Each residual lists the unknown attributes needed to compute its contribution along with the
+// residual CEL expressions which a downstream system may use to finish the evaluation.
+//
+// The engine must be configured with the PartialEval option.
+func (e *Engine) EvalPartial(ctx context.Context,
+	vars map[string]interface{},
+	selector model.DecisionSelector,
+	unknowns ...*interpreter.AttributePattern) ([]model.DecisionValue, []*runtime.Residual, error) {
+	if !e.partial {
+		return nil, nil, fmt.Errorf("partial evaluation not enabled")
+	}
+	ev, err := e.newEvaluation(ctx, selector)
+	if err != nil {
+		return nil, nil, err
+	}
+	ev.SetUnknowns(unknowns...)
+	decisions, err := e.evalInternal(ev, vars)
+	return decisions, ev.Residuals(), err
 }
 
 // AddInstance configures the engine with a given instance.
 //
 // Instances are grouped together by their 'kind' field which corresponds to a template
 // metadata.name value.
+//
+// The template terms which depend only on the instance rules are evaluated once when the instance
+// is added, and their values are reused by each evaluation of the instance. The terms are
+// evaluated before the instance is added, without blocking concurrent evaluations, and within the
+// EvaluationCostLimit configured for the engine.
 func (e *Engine) AddInstance(inst *model.Instance) error {
-	_, found := e.FindTemplate(inst.Kind)
+	rt := e.prepareInstance(inst)
+	e.rwMux.Lock()
+	defer e.rwMux.Unlock()
+	_, found := e.findTemplateLocked(inst.Kind)
 	if !found {
+		e.releasePrepared(rt, inst)
 		return fmt.Errorf(
 			"template not found: instance=%s, template=%s",
-			inst.Kind, inst.Metadata.Name)
+			inst.Metadata.Name, inst.Kind)
 	}
-	insts, found := e.instances[inst.Kind]
+	if err := e.checkSelectors(inst); err != nil {
+		e.releasePrepared(rt, inst)
+		return err
+	}
+	e.checkPrepared(rt, inst)
+	e.setInstances(inst.Kind, insertInstance(e.instances[inst.Kind], inst))
+	e.indexInstance(inst)
+	return nil
+}
+
+// ReplaceInstance configures the engine with a given instance, replacing the previously configured
+// instance of the same 'kind' whose metadata namespace and name match the incoming instance.
+//
+// If no such instance exists, the instance is added as though by AddInstance.
+func (e *Engine) ReplaceInstance(inst *model.Instance) error {
+	rt := e.prepareInstance(inst)
+	e.rwMux.Lock()
+	defer e.rwMux.Unlock()
+	_, found := e.findTemplateLocked(inst.Kind)
 	if !found {
-		insts = []*model.Instance{}
+		e.releasePrepared(rt, inst)
+		return fmt.Errorf(
+			"template not found: instance=%s, template=%s",
+			inst.Metadata.Name, inst.Kind)
+	}
+	if err := e.checkSelectors(inst); err != nil {
+		e.releasePrepared(rt, inst)
+		return err
 	}
-	insts = append(insts, inst)
-	e.instances[inst.Kind] = insts
+	e.checkPrepared(rt, inst)
+	insts := e.instances[inst.Kind]
+	replaced := false
+	updated := make([]*model.Instance, 0, len(insts)+1)
+	for _, prev := range insts {
+		if !sameInstance(prev, inst.Metadata.Namespace, inst.Metadata.Name) {
+			updated = append(updated, prev)
+			continue
+		}
+		e.unindexInstance(prev)
+		if prev != inst {
+			e.releaseInstance(prev)
+		}
+		// Replace the first matching instance in place and drop any duplicates which may have
+		// been configured via AddInstance.
+		if !replaced {
+			updated = append(updated, inst)
+			replaced = true
+		}
+	}
+	if !replaced {
+		updated = insertInstance(updated, inst)
+	}
+	e.setInstances(inst.Kind, updated)
+	e.indexInstance(inst)
 	return nil
 }
 
+// RemoveInstance removes the instance of the given 'kind' whose metadata namespace and name match
+// the provided values, and returns whether such an instance was found.
+func (e *Engine) RemoveInstance(kind, namespace, name string) bool {
+	e.rwMux.Lock()
+	defer e.rwMux.Unlock()
+	insts, found := e.instances[kind]
+	if !found {
+		return false
+	}
+	removed := false
+	updated := make([]*model.Instance, 0, len(insts))
+	for _, inst := range insts {
+		if sameInstance(inst, namespace, name) {
+			e.unindexInstance(inst)
+			e.releaseInstance(inst)
+			removed = true
+			continue
+		}
+		updated = append(updated, inst)
+	}
+	e.setInstances(kind, updated)
+	return removed
+}
+
 // SetTemplate associates a fully qualified template names with a template instance while
 // configuring the template runtime.
+//
+// The template runtime is configured before the template is registered so that concurrent
+// evaluations observe either the prior template or the new one, but never a partial update.
 func (e *Engine) SetTemplate(name string, tmpl *model.Template) error {
-	err := e.Registry.SetTemplate(name, tmpl)
-	if err != nil {
-		return err
-	}
 	rtOpts := []runtime.TemplateOption{
 		runtime.Limits(e.limits),
 		runtime.ExprOptions(e.evalOpts...),
 	}
 	rtOpts = append(rtOpts, e.rtOpts...)
+	rtOpts = append(rtOpts, e.tmplOpts[tmpl.Metadata.Name]...)
 	rtTmpl, err := runtime.NewTemplate(e.Registry, tmpl, rtOpts...)
 	if err != nil {
 		return err
 	}
+	// The configured instances are prepared for the new runtime without holding the engine lock,
+	// and reconciled with the instances configured once the lock is held.
+	e.rwMux.RLock()
+	insts := append([]*model.Instance{}, e.instances[tmpl.Metadata.Name]...)
+	e.rwMux.RUnlock()
+	for _, inst := range insts {
+		rtTmpl.PrepareInstance(e.preparation(), inst)
+	}
+	e.rwMux.Lock()
+	defer e.rwMux.Unlock()
+	err = e.checkDecisionDecls(tmpl)
+	if err != nil {
+		return err
+	}
+	err = e.Registry.SetTemplate(name, tmpl)
+	if err != nil {
+		return err
+	}
+	e.syncPrepared(rtTmpl, insts, e.instances[tmpl.Metadata.Name])
 	e.runtimes[tmpl.Metadata.Name] = rtTmpl
 	return nil
 }
 
+// syncPrepared reconciles the instances prepared for a new runtime with the instances currently
+// configured. Instances removed or replaced since they were prepared are released, and instances
+// added since then are prepared.
+func (e *Engine) syncPrepared(rt *runtime.Template, prepared, current []*model.Instance) {
+	configured := make(map[*model.Instance]struct{}, len(current))
+	for _, inst := range current {
+		configured[inst] = struct{}{}
+	}
+	seen := make(map[*model.Instance]struct{}, len(prepared))
+	for _, inst := range prepared {
+		seen[inst] = struct{}{}
+		if _, found := configured[inst]; !found {
+			rt.ReleaseInstance(inst)
+		}
+	}
+	for _, inst := range current {
+		if _, found := seen[inst]; !found {
+			rt.PrepareInstance(e.preparation(), inst)
+		}
+	}
+}
+
+// checkDecisionDecls returns an error if the template declares a decision with a different
+// aggregation than another configured template, as the decision values aggregated for the
+// templates could not be combined.
+func (e *Engine) checkDecisionDecls(tmpl *model.Template) error {
+	var others []string
+	for name := range e.runtimes {
+		if name != tmpl.Metadata.Name {
+			others = append(others, name)
+		}
+	}
+	sort.Strings(others)
+	for _, d := range tmpl.Decisions {
+		for _, name := range others {
+			other, found := e.findTemplateLocked(name)
+			if !found {
+				continue
+			}
+			decl, found := other.FindDecisionDecl(d.Name)
+			if found && decl.Aggregate != d.Aggregate {
+				return fmt.Errorf(
+					"decision %s: declared aggregation %s conflicts with template %s aggregation: %s",
+					d.Name, d.Aggregate, name, decl.Aggregate)
+			}
+		}
+	}
+	return nil
+}
+
+// RemoveTemplate removes the template registered under the fully qualified template name along
+// with its runtime and all instances of the template, and returns whether the template was found.
+func (e *Engine) RemoveTemplate(name string) bool {
+	e.rwMux.Lock()
+	defer e.rwMux.Unlock()
+	tmpl, found := e.findTemplateLocked(name)
+	if !found {
+		return false
+	}
+	e.Registry.RemoveTemplate(name)
+	delete(e.runtimes, tmpl.Metadata.Name)
+	e.setInstances(name, nil)
+	if e.indexes != nil {
+		delete(e.indexes, name)
+	}
+	return true
+}
+
 // CompileEnv parses and compiles an input source into a model.Env.
 func (e *Engine) CompileEnv(src *model.Source) (*model.Env, *Issues) {
 	ast, iss := parser.ParseYaml(src)
@@ -158,47 +433,436 @@ func (e *Engine) CompileTemplate(src *model.Source) (*model.Template, *Issues) {
 	return c.CompileTemplate(src, ast)
 }
 
-func (e *Engine) evalInternal(vars map[string]interface{},
-	selector model.DecisionSelector) ([]model.DecisionValue, error) {
+// newEvaluation creates an Evaluation at the time given by the engine's Clock, limited by the
+// engine's EvaluationCostLimit and ContinueOnError settings, and configured with the given
+// options.
+func (e *Engine) newEvaluation(ctx context.Context,
+	selector model.DecisionSelector,
+	opts ...EvalOption) (*runtime.Evaluation, error) {
+	ev := runtime.NewEvaluation(ctx, selector)
+	ev.SetTime(e.clock())
+	ev.SetCostLimit(e.limits.EvaluationCostLimit)
+	ev.SetContinueOnError(e.contOnErr)
+	var err error
+	for _, opt := range opts {
+		ev, err = opt(ev)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ev, nil
+}
+
+func (e *Engine) evalInternal(ev *runtime.Evaluation,
+	vars map[string]interface{}) ([]model.DecisionValue, error) {
 	input := e.actPool.Get().(*activation)
 	input.vars = vars
-	var decisions []model.DecisionValue
-	for tmplName, insts := range e.instances {
+	defer e.actPool.Put(input)
+	return e.evalInput(ev, input, nil)
+}
+
+// evalInput evaluates the instances configured at the time of the call against the input.
+//
+// The advisory instances are evaluated into the advisory evaluations when provided, and are
+// skipped otherwise.
+func (e *Engine) evalInput(ev *runtime.Evaluation,
+	input *activation,
+	adv *advisoryEvals) ([]model.DecisionValue, error) {
+	e.rwMux.RLock()
+	defer e.rwMux.RUnlock()
+	if e.workers > 1 {
+		return e.evalParallel(ev, input, adv)
+	}
+	requested, bounded := e.requestedDecisions(ev)
+	var errs runtime.EvalErrors
+	for _, tmplName := range e.kinds {
+		insts := e.candidateInstances(tmplName, input)
 		rt, found := e.runtimes[tmplName]
 		if !found {
 			// Report an error
 			continue
 		}
 		for _, inst := range insts {
+			if inst.IsAdvisory() && adv == nil || !inst.IsActive(ev.Time()) {
+				continue
+			}
+			if bounded && ev.IsFinal(requested...) && adv == nil {
+				return evalResult(ev, errs)
+			}
+			if err := ev.Err(); err != nil {
+				return ev.FinalDecisions(), err
+			}
 			if !e.selectInstance(inst, input) {
 				continue
 			}
-			decs, err := rt.Eval(inst, input, selector)
+			target := ev
+			var ae *advisoryEval
+			if inst.IsAdvisory() {
+				ae = adv.get(inst.EnforcementAction)
+				target = ae.ev
+			}
+			if bounded && target.IsFinal(requested...) {
+				continue
+			}
+			err := rt.EvalInstance(target, inst, input)
 			if err != nil {
-				e.actPool.Put(input)
-				return nil, err
+				if ev.Err() != nil {
+					return ev.FinalDecisions(), err
+				}
+				if ae != nil {
+					ae.fail(err)
+					continue
+				}
+				evalErrs, ok := err.(runtime.EvalErrors)
+				if !ok || !ev.ContinueOnError() {
+					return nil, err
+				}
+				errs = append(errs, evalErrs...)
 			}
-			decisions = append(decisions, decs...)
 		}
 	}
-	e.actPool.Put(input)
-	return decisions, nil
+	return evalResult(ev, errs)
+}
+
+// evalResult returns the decisions aggregated within the evaluation along with the errors of the
+// instances which failed, if any, when the engine is configured to continue on error.
+func evalResult(ev *runtime.Evaluation,
+	errs runtime.EvalErrors) ([]model.DecisionValue, error) {
+	if len(errs) != 0 {
+		return ev.Decisions(), errs
+	}
+	return ev.Decisions(), nil
 }
 
+// evalParallel evaluates the selected instances concurrently using a bounded set of workers.
+//
+// Each instance is evaluated against its own forked Evaluation and the results are merged into
+// the Evaluation in the same order in which the instances would have been evaluated sequentially,
+// so the decisions and errors produced are the same as for sequential evaluation. Once the
+// requested decisions are final, or an error is encountered, the remaining work is cancelled.
+func (e *Engine) evalParallel(ev *runtime.Evaluation,
+	input *activation,
+	adv *advisoryEvals) ([]model.DecisionValue, error) {
+	ctx := ev.Context()
+	workCtx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	// Cancel the outstanding work and wait for the workers to exit before the input activation
+	// is returned to its pool and the engine read lock is released.
+	defer wg.Wait()
+	defer cancel()
+	requested, bounded := e.requestedDecisions(ev)
+	var jobs []*instanceJob
+	for _, tmplName := range e.kinds {
+		rt, found := e.runtimes[tmplName]
+		if !found {
+			continue
+		}
+		for _, inst := range e.candidateInstances(tmplName, input) {
+			if inst.IsAdvisory() && adv == nil || !inst.IsActive(ev.Time()) ||
+				!e.selectInstance(inst, input) {
+				continue
+			}
+			job := &instanceJob{
+				rt:     rt,
+				inst:   inst,
+				target: ev,
+				ev:     ev.Fork(workCtx),
+				done:   make(chan struct{}),
+			}
+			if inst.IsAdvisory() {
+				job.adv = adv.get(inst.EnforcementAction)
+				job.target = job.adv.ev
+			}
+			jobs = append(jobs, job)
+		}
+	}
+	queue := make(chan *instanceJob, len(jobs))
+	for _, job := range jobs {
+		queue <- job
+	}
+	close(queue)
+	workers := e.workers
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				job.eval(input)
+			}
+		}()
+	}
+	var errs runtime.EvalErrors
+	for _, job := range jobs {
+		if bounded && job.target.IsFinal(requested...) {
+			if adv == nil {
+				return evalResult(ev, errs)
+			}
+			continue
+		}
+		<-job.done
+		if err := ev.Err(); err != nil {
+			return ev.FinalDecisions(), err
+		}
+		if job.adv != nil {
+			if job.err != nil {
+				job.adv.fail(job.err)
+			}
+			if err := job.rt.MergeEvaluation(job.target, job.ev); err != nil {
+				job.adv.fail(err)
+			}
+			continue
+		}
+		if job.err != nil {
+			evalErrs, ok := job.err.(runtime.EvalErrors)
+			if !ok || !ev.ContinueOnError() {
+				return nil, job.err
+			}
+			errs = append(errs, evalErrs...)
+		}
+		err := job.rt.MergeEvaluation(ev, job.ev)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return evalResult(ev, errs)
+}
+
+// instanceJob describes the evaluation of a single instance by a parallel evaluation worker.
+//
+// The forked evaluation is merged into the target evaluation, which is either the enforced
+// evaluation or, for advisory instances, the evaluation of the instance's enforcement action.
+type instanceJob struct {
+	rt     *runtime.Template
+	inst   *model.Instance
+	target *runtime.Evaluation
+	adv    *advisoryEval
+	ev     *runtime.Evaluation
+	err    error
+	done   chan struct{}
+}
+
+func (job *instanceJob) eval(input *activation) {
+	defer close(job.done)
+	if err := job.ev.Err(); err != nil {
+		job.err = err
+		return
+	}
+	job.err = job.rt.EvalInstance(job.ev, job.inst, input)
+}
+
+// requestedDecisions returns the names of the decisions which may be produced by the configured
+// templates and which are selected for the evaluation.
+//
+// When a template produces decisions via a decision reference, the set of decision names cannot
+// be determined ahead of evaluation and the result is reported as unbounded, in which case all of
+// the candidate instances must be evaluated.
+func (e *Engine) requestedDecisions(ev *runtime.Evaluation) ([]string, bool) {
+	var names []string
+	seen := map[string]struct{}{}
+	for _, tmplName := range e.kinds {
+		rt, found := e.runtimes[tmplName]
+		if !found {
+			continue
+		}
+		if rt.HasDecisionReferences() {
+			return nil, false
+		}
+		for _, name := range rt.DecisionNames() {
+			if _, found := seen[name]; found || !ev.Selects(name) {
+				continue
+			}
+			seen[name] = struct{}{}
+			names = append(names, name)
+		}
+	}
+	return names, true
+}
+
+// checkSelectors returns an error if the instance has a selector whose type is not declared via
+// SupportedSelectors, as the instance would otherwise never be selected.
+func (e *Engine) checkSelectors(inst *model.Instance) error {
+	if e.selTypes == nil {
+		return nil
+	}
+	for _, sel := range inst.Selectors {
+		if _, found := e.selTypes[reflect.TypeOf(sel)]; !found {
+			return fmt.Errorf(
+				"unsupported selector: instance=%s, selector=%T",
+				inst.Metadata.Name, sel)
+		}
+	}
+	return nil
+}
+
+// selectInstance returns whether all of the instance selectors match the input.
+//
+// Each instance selector must be matched by at least one of the configured Selector functions.
+// When no Selector functions are configured, all instances are selected.
 func (e *Engine) selectInstance(inst *model.Instance, input interpreter.Activation) bool {
 	if len(inst.Selectors) == 0 || len(e.selectors) == 0 {
 		return true
 	}
+	for _, sel := range inst.Selectors {
+		if !e.matchSelector(sel, input) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *Engine) matchSelector(sel model.Selector, input interpreter.Activation) bool {
 	for _, selFn := range e.selectors {
-		for _, sel := range inst.Selectors {
-			if selFn(sel, input) {
-				return true
-			}
+		if selFn(sel, input) {
+			return true
 		}
 	}
 	return false
 }
 
+// candidateInstances returns the instances of the given kind which may be selected for the input.
+//
+// When the selector index is enabled, only instances whose indexed selectors may match the input
+// labels are returned; otherwise, all instances of the kind are returned.
+func (e *Engine) candidateInstances(kind string, input interpreter.Activation) []*model.Instance {
+	if e.indexes == nil || len(e.selectors) == 0 {
+		return e.instances[kind]
+	}
+	idx, found := e.indexes[kind]
+	if !found {
+		return e.instances[kind]
+	}
+	lbls, _ := resolvePath(input, e.lblsPath)
+	return idx.candidates(lbls)
+}
+
+// findTemplateLocked returns the template registered under the name. The caller must hold the
+// engine lock so that the template is not removed or replaced before the result is used.
+func (e *Engine) findTemplateLocked(name string) (*model.Template, bool) {
+	return e.Registry.FindTemplate(name)
+}
+
+// prepareInstance evaluates the terms of the instance's template runtime which only depend on the
+// instance rules ahead of evaluation, and returns the runtime, if found.
+//
+// The engine lock is only held while the runtime is found, so that evaluations may proceed while
+// the terms are evaluated.
+func (e *Engine) prepareInstance(inst *model.Instance) *runtime.Template {
+	e.rwMux.RLock()
+	rt, found := e.runtimes[inst.Kind]
+	e.rwMux.RUnlock()
+	if !found {
+		return nil
+	}
+	rt.PrepareInstance(e.preparation(), inst)
+	return rt
+}
+
+// preparation returns an Evaluation which bounds the preparation of an instance by the evaluation
+// cost limit configured for the engine.
+func (e *Engine) preparation() *runtime.Evaluation {
+	ev := runtime.NewEvaluation(context.Background(), nil)
+	ev.SetCostLimit(e.limits.EvaluationCostLimit)
+	return ev
+}
+
+// releasePrepared discards the term values prepared for an instance which could not be added.
+func (e *Engine) releasePrepared(rt *runtime.Template, inst *model.Instance) {
+	if rt != nil {
+		rt.ReleaseInstance(inst)
+	}
+}
+
+// checkPrepared prepares the instance for the current runtime of its template when the runtime
+// was replaced after the instance was prepared for the prior one.
+func (e *Engine) checkPrepared(rt *runtime.Template, inst *model.Instance) {
+	cur, found := e.runtimes[inst.Kind]
+	if !found || cur == rt {
+		return
+	}
+	e.releasePrepared(rt, inst)
+	cur.PrepareInstance(e.preparation(), inst)
+}
+
+// releaseInstance discards the term values prepared for an instance which is no longer
+// configured.
+func (e *Engine) releaseInstance(inst *model.Instance) {
+	if rt, found := e.runtimes[inst.Kind]; found {
+		rt.ReleaseInstance(inst)
+	}
+}
+
+// indexInstance adds the instance to the selector index for its kind, if the index is enabled.
+func (e *Engine) indexInstance(inst *model.Instance) {
+	if e.indexes == nil {
+		return
+	}
+	idx, found := e.indexes[inst.Kind]
+	if !found {
+		idx = newSelectorIndex()
+		e.indexes[inst.Kind] = idx
+	}
+	idx.add(inst)
+}
+
+// unindexInstance removes the instance from the selector index for its kind, if present.
+func (e *Engine) unindexInstance(inst *model.Instance) {
+	if e.indexes == nil {
+		return
+	}
+	idx, found := e.indexes[inst.Kind]
+	if found {
+		idx.remove(inst)
+	}
+}
+
+// setInstances updates the instances associated with a template name while maintaining the
+// sorted set of template names which have instances.
+func (e *Engine) setInstances(kind string, insts []*model.Instance) {
+	idx := sort.SearchStrings(e.kinds, kind)
+	hasKind := idx < len(e.kinds) && e.kinds[idx] == kind
+	if len(insts) == 0 {
+		delete(e.instances, kind)
+		if hasKind {
+			e.kinds = append(e.kinds[:idx], e.kinds[idx+1:]...)
+		}
+		return
+	}
+	e.instances[kind] = insts
+	if !hasKind {
+		e.kinds = append(e.kinds, "")
+		copy(e.kinds[idx+1:], e.kinds[idx:])
+		e.kinds[idx] = kind
+	}
+}
+
+// insertInstance inserts the instance into the list, sorted by metadata namespace and name, after
+// any instances which share the same namespace and name.
+func insertInstance(insts []*model.Instance, inst *model.Instance) []*model.Instance {
+	idx := sort.Search(len(insts), func(i int) bool {
+		return instanceLess(inst, insts[i])
+	})
+	insts = append(insts, nil)
+	copy(insts[idx+1:], insts[idx:])
+	insts[idx] = inst
+	return insts
+}
+
+// instanceLess orders instances by metadata namespace, then by name.
+func instanceLess(a, b *model.Instance) bool {
+	if a.Metadata.Namespace != b.Metadata.Namespace {
+		return a.Metadata.Namespace < b.Metadata.Namespace
+	}
+	return a.Metadata.Name < b.Metadata.Name
+}
+
+// sameInstance returns whether the instance's metadata namespace and name match the given values.
+func sameInstance(inst *model.Instance, namespace, name string) bool {
+	return inst.Metadata.Namespace == namespace && inst.Metadata.Name == name
+}
+
 // DecisionNames filters the decision set which can be produced by the engine to a specific set
 // of named decisions.
 func DecisionNames(selected ...string) model.DecisionSelector {
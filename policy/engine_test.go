@@ -15,8 +15,11 @@
 package policy
 
 import (
+	"context"
 	"fmt"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -26,7 +29,10 @@ import (
 
 	"github.com/google/cel-go/cel"
 	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
 	"github.com/google/cel-go/interpreter"
+	"github.com/google/cel-go/interpreter/functions"
 )
 
 type metadata struct {
@@ -123,7 +129,8 @@ var (
 			policy: "greeting",
 			input: map[string]interface{}{
 				"resource.labels": map[string]string{
-					"env": "prod",
+					"env":   "prod",
+					"debug": "false",
 				},
 			},
 			outputs: []interface{}{
@@ -414,7 +421,7 @@ func TestEngine(t *testing.T) {
 		t.Run(tst.name, func(tt *testing.T) {
 			opts := []EngineOption{
 				StandardExprEnv(env),
-				Selectors(labelSelector),
+				Selectors(LabelSelector("resource.labels"), ExpressionSelector("resource.labels")),
 				RangeLimit(1),
 				RuntimeTemplateOptions(
 					runtime.Functions(test.Funcs...),
@@ -521,7 +528,7 @@ func BenchmarkEngine(b *testing.B) {
 		tst := tstVal
 		opts := []EngineOption{
 			StandardExprEnv(env),
-			Selectors(labelSelector),
+			Selectors(LabelSelector("resource.labels"), ExpressionSelector("resource.labels")),
 			RangeLimit(1),
 			RuntimeTemplateOptions(
 				runtime.Functions(test.Funcs...),
@@ -590,42 +597,1971 @@ func BenchmarkEngine(b *testing.B) {
 			}
 		}
 	}
+	for _, cnt := range []int{100, 1000, 10000} {
+		for _, indexed := range []bool{false, true} {
+			var opts []EngineOption
+			if indexed {
+				opts = append(opts, SelectorIndex("resource.labels"))
+			}
+			engine, inst := newTestEngine(b, "resource_types", opts...)
+			for i := 0; i < cnt; i++ {
+				err := engine.AddInstance(labeledInstance(inst, fmt.Sprintf("app-%d", i),
+					&model.LabelSelector{LabelValues: map[string]string{
+						"env": "prod",
+						"app": fmt.Sprintf("app-%d", i),
+					}}))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			vars := map[string]interface{}{
+				"resource.type": "sqladmin.googleapis.com/Instance",
+				"resource.name": "forbidden-my-sql-instance",
+				"resource.labels": map[string]string{
+					"env": "prod",
+					"app": "app-7",
+				},
+			}
+			name := fmt.Sprintf("selector_index/instances=%d/indexed=%t", cnt, indexed)
+			b.Run(name, func(bb *testing.B) {
+				for i := 0; i < bb.N; i++ {
+					_, err := engine.EvalAll(vars)
+					if err != nil {
+						bb.Fatal(err)
+					}
+				}
+			})
+		}
+	}
 }
 
-func decisionMatchesOutput(dec model.DecisionValue, out interface{}) (bool, error) {
-	switch dv := dec.(type) {
-	case *model.BoolDecisionValue:
-		ntv, err := dv.Value().ConvertToNative(reflect.TypeOf(out))
-		return err == nil && reflect.DeepEqual(ntv, out), nil
-	case *model.ListDecisionValue:
-		vals := dv.Values()
-		for _, val := range vals {
-			ntv, err := val.ConvertToNative(reflect.TypeOf(out))
-			if err == nil && reflect.DeepEqual(ntv, out) {
-				return true, nil
+// BenchmarkEngine_EvalBatch compares evaluating a batch of inputs by calling EvalAll for each
+// input with the equivalent EvalBatch call.
+func BenchmarkEngine_EvalBatch(b *testing.B) {
+	inputs := batchInputs(1000)
+	newEngine := func(opts ...EngineOption) *Engine {
+		engine, inst := newTestEngine(b, "sensitive_data", opts...)
+		for i := 0; i < 10; i++ {
+			err := engine.AddInstance(labeledInstance(inst, fmt.Sprintf("secrets_%02d", i)))
+			if err != nil {
+				b.Fatal(err)
 			}
 		}
+		return engine
 	}
-	return false, nil
+	engine := newEngine()
+	b.Run("eval_all_loop", func(bb *testing.B) {
+		for i := 0; i < bb.N; i++ {
+			for _, input := range inputs {
+				_, err := engine.EvalAll(input)
+				if err != nil {
+					bb.Fatal(err)
+				}
+			}
+		}
+	})
+	for _, workers := range []int{1, 4} {
+		engine := newEngine(BatchParallelism(workers))
+		b.Run(fmt.Sprintf("eval_batch/workers=%d", workers), func(bb *testing.B) {
+			handler := func(res *BatchResult) error {
+				return res.Err
+			}
+			for i := 0; i < bb.N; i++ {
+				err := engine.EvalBatch(context.Background(), SliceInputs(inputs), nil, handler)
+				if err != nil {
+					bb.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestEngine_InstanceLifecycle(t *testing.T) {
+	engine, inst := newTestEngine(t, "sensitive_data")
+	input := map[string]interface{}{
+		"destination.ip":  "10.0.0.1",
+		"origin.ip":       "10.0.0.2",
+		"resource.name":   "/company/acme/secrets/doomsday-device",
+		"resource.labels": map[string]string{},
+	}
+	err := engine.AddInstance(inst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decisions, err := engine.EvalAll(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decisions) != 1 {
+		t.Fatalf("got %v, wanted one decision", decisions)
+	}
+
+	// Replace the instance with a copy that contains no rules.
+	noRules := *inst
+	noRules.Rules = []model.Rule{}
+	err = engine.ReplaceInstance(&noRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(engine.instances["sensitive_data"]) != 1 {
+		t.Fatalf("got %d instances, wanted 1", len(engine.instances["sensitive_data"]))
+	}
+	decisions, err = engine.EvalAll(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decisions) != 0 {
+		t.Errorf("got %v, wanted no decisions after replacement", decisions)
+	}
+
+	// Remove the instance.
+	if !engine.RemoveInstance("sensitive_data", "acme", "secret_acme_resources") {
+		t.Error("RemoveInstance() returned false, wanted true")
+	}
+	if engine.RemoveInstance("sensitive_data", "acme", "secret_acme_resources") {
+		t.Error("RemoveInstance() of a removed instance returned true, wanted false")
+	}
+
+	// Removing the template cascades to its instances.
+	err = engine.ReplaceInstance(inst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !engine.RemoveTemplate("sensitive_data") {
+		t.Error("RemoveTemplate() returned false, wanted true")
+	}
+	if _, found := engine.FindTemplate("sensitive_data"); found {
+		t.Error("FindTemplate() found a removed template")
+	}
+	decisions, err = engine.EvalAll(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decisions) != 0 {
+		t.Errorf("got %v, wanted no decisions after template removal", decisions)
+	}
+	if engine.AddInstance(inst) == nil {
+		t.Error("AddInstance() succeeded for a removed template")
+	}
+}
+
+func TestEngine_ConcurrentEval(t *testing.T) {
+	engine, inst := newTestEngine(t, "timed_contract")
+	input := map[string]interface{}{
+		"resource.name": "/company/warneranimstudios/goodbye",
+		"request.time":  time.Unix(1646416000, 0).UTC(),
+	}
+	err := engine.AddInstance(inst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The template has no validator, so the CEL values of the instance rules are first computed
+	// by the concurrent evaluations.
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				decisions, err := engine.EvalAll(input)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if len(decisions) != 1 {
+					errs <- fmt.Errorf("got %v, wanted one decision", decisions)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestEngine_ConcurrentMutation(t *testing.T) {
+	engine, inst := newTestEngine(t, "sensitive_data")
+	tmpl, _ := engine.FindTemplate("sensitive_data")
+	input := map[string]interface{}{
+		"destination.ip":  "10.0.0.1",
+		"origin.ip":       "10.0.0.2",
+		"resource.name":   "/company/acme/secrets/doomsday-device",
+		"resource.labels": map[string]string{},
+	}
+	err := engine.AddInstance(inst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	errs := make(chan error, 16)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				decisions, err := engine.EvalAll(input)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if len(decisions) > 1 {
+					errs <- fmt.Errorf("got %v, wanted at most one decision", decisions)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 200; i++ {
+		switch i % 4 {
+		case 0:
+			err = engine.ReplaceInstance(inst)
+		case 1:
+			engine.RemoveInstance(inst.Kind, inst.Metadata.Namespace, inst.Metadata.Name)
+		case 2:
+			err = engine.SetTemplate(tmpl.Metadata.Name, tmpl)
+		case 3:
+			err = engine.AddInstance(inst)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestEngine_ConcurrentTemplateRemoval(t *testing.T) {
+	engine, inst := newTestEngine(t, "sensitive_data")
+	// Hold the engine lock while the instance is added, and remove the template as though by a
+	// concurrent RemoveTemplate call before the lock is released.
+	engine.rwMux.Lock()
+	added := make(chan error)
+	go func() {
+		added <- engine.AddInstance(inst)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	engine.Registry.RemoveTemplate("sensitive_data")
+	delete(engine.runtimes, "sensitive_data")
+	engine.rwMux.Unlock()
+	err := <-added
+	if err == nil {
+		t.Error("AddInstance() succeeded for a removed template")
+	}
+	if len(engine.instances["sensitive_data"]) != 0 {
+		t.Errorf("got instances %v, wanted none for a removed template",
+			engine.instances["sensitive_data"])
+	}
+}
+
+func TestEngine_EvalContext(t *testing.T) {
+	engine, inst := newTestEngine(t, "sensitive_data")
+	err := engine.AddInstance(inst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := map[string]interface{}{
+		"destination.ip":  "10.0.0.1",
+		"origin.ip":       "10.0.0.2",
+		"resource.name":   "/company/acme/secrets/doomsday-device",
+		"resource.labels": map[string]string{},
+	}
+	decisions, err := engine.EvalContext(context.Background(), input, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decisions) != 1 {
+		t.Errorf("got %v, wanted one decision", decisions)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	decisions, err = engine.EvalContext(cancelled, input, nil)
+	if err != context.Canceled {
+		t.Errorf("got error %v, wanted %v", err, context.Canceled)
+	}
+	if len(decisions) != 0 {
+		t.Errorf("got %v, wanted no decisions", decisions)
+	}
+
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	_, err = engine.EvalContext(expired, input, nil)
+	if err != context.DeadlineExceeded {
+		t.Errorf("got error %v, wanted %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestEngine_CostLimit(t *testing.T) {
+	input := map[string]interface{}{
+		"destination.ip":  "10.0.0.1",
+		"origin.ip":       "10.0.0.2",
+		"resource.name":   "/company/acme/secrets/doomsday-device",
+		"resource.labels": map[string]string{},
+	}
+	for _, workers := range []int{1, 4} {
+		engine, inst := newTestEngine(t, "sensitive_data",
+			EvaluationCostLimit(2), Parallelism(workers))
+		for i := 0; i < 4; i++ {
+			err := engine.AddInstance(labeledInstance(inst, fmt.Sprintf("secrets_%02d", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err := engine.EvalContext(context.Background(), input, nil)
+		costErr, ok := err.(*runtime.CostLimitError)
+		if !ok {
+			t.Fatalf("workers=%d: got error %v, wanted a cost limit error", workers, err)
+		}
+		if costErr.Limit != 2 {
+			t.Errorf("workers=%d: got limit %d, wanted 2", workers, costErr.Limit)
+		}
+
+		decisions, err := engine.EvalContext(context.Background(), input, nil, CostLimit(-1))
+		if err != nil {
+			t.Fatalf("workers=%d: %v", workers, err)
+		}
+		if len(decisions) != 1 {
+			t.Errorf("workers=%d: got %v, wanted one decision", workers, decisions)
+		}
+		decisions, err = engine.EvalContext(context.Background(), input, nil, CostLimit(1000))
+		if err != nil {
+			t.Fatalf("workers=%d: %v", workers, err)
+		}
+		if len(decisions) != 1 {
+			t.Errorf("workers=%d: got %v, wanted one decision", workers, decisions)
+		}
+	}
+}
+
+func TestEngine_EvalBatch(t *testing.T) {
+	inputs := batchInputs(20)
+	for _, workers := range []int{1, 4} {
+		engine, inst := newTestEngine(t, "sensitive_data", BatchParallelism(workers))
+		err := engine.AddInstance(inst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []int
+		err = engine.EvalBatch(context.Background(), SliceInputs(inputs), nil,
+			func(res *BatchResult) error {
+				got = append(got, res.Index)
+				if res.Err != nil {
+					t.Fatalf("workers=%d: input %d: %v", workers, res.Index, res.Err)
+				}
+				want, err := engine.EvalAll(res.Input)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(res.Decisions, want) {
+					t.Errorf("workers=%d: input %d: got %v, wanted %v",
+						workers, res.Index, res.Decisions, want)
+				}
+				return nil
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(inputs) {
+			t.Fatalf("workers=%d: got %d results, wanted %d", workers, len(got), len(inputs))
+		}
+		for i, idx := range got {
+			if idx != i {
+				t.Fatalf("workers=%d: got results in order %v, wanted input order", workers, got)
+			}
+		}
+
+		// A handler error stops the batch.
+		stop := fmt.Errorf("stop")
+		calls := 0
+		err = engine.EvalBatch(context.Background(), SliceInputs(inputs), nil,
+			func(res *BatchResult) error {
+				calls++
+				if res.Index == 3 {
+					return stop
+				}
+				return nil
+			})
+		if err != stop || calls != 4 {
+			t.Errorf("workers=%d: got error %v after %d calls, wanted %v after 4 calls",
+				workers, err, calls, stop)
+		}
+
+		// Cancelling the context stops the batch.
+		cancelled, cancel := context.WithCancel(context.Background())
+		cancel()
+		err = engine.EvalBatch(cancelled, SliceInputs(inputs), nil,
+			func(res *BatchResult) error {
+				t.Errorf("workers=%d: got result %v, wanted none", workers, res)
+				return nil
+			})
+		if err != context.Canceled {
+			t.Errorf("workers=%d: got error %v, wanted %v", workers, err, context.Canceled)
+		}
+
+		// Per-input failures are reported within the results without stopping the batch.
+		calls = 0
+		err = engine.EvalBatch(context.Background(), SliceInputs(inputs), nil,
+			func(res *BatchResult) error {
+				calls++
+				if _, ok := res.Err.(*runtime.CostLimitError); !ok {
+					t.Errorf("workers=%d: got error %v, wanted a cost limit error", workers, res.Err)
+				}
+				return nil
+			}, CostLimit(0))
+		if err != nil || calls != len(inputs) {
+			t.Errorf("workers=%d: got error %v after %d calls, wanted %d calls",
+				workers, err, calls, len(inputs))
+		}
+	}
+}
+
+// batchInputs returns inputs for the sensitive_data policy which alternate between denied and
+// permitted requests.
+func batchInputs(count int) []map[string]interface{} {
+	inputs := make([]map[string]interface{}, count)
+	for i := range inputs {
+		origin := "10.0.0.2"
+		if i%2 == 0 {
+			origin = "10.0.0.1"
+		}
+		inputs[i] = map[string]interface{}{
+			"destination.ip":  "10.0.0.1",
+			"origin.ip":       origin,
+			"resource.name":   fmt.Sprintf("/company/acme/secrets/device-%d", i),
+			"resource.labels": map[string]string{},
+		}
+	}
+	return inputs
 }
 
-func labelSelector(sel model.Selector, vars interpreter.Activation) bool {
-	switch s := sel.(type) {
-	case *model.LabelSelector:
-		lbls, found := vars.ResolveName("resource.labels")
-		if !found {
-			return len(s.LabelValues) == 0
+func TestEngine_DeterministicOrder(t *testing.T) {
+	engine, inst := newTestEngine(t, "resource_types")
+	for _, name := range []string{"charlie", "alpha", "bravo"} {
+		named := *inst
+		named.Metadata = &model.InstanceMetadata{Namespace: "acme", Name: name}
+		err := engine.AddInstance(&named)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	input := map[string]interface{}{
+		"resource.type": "sqladmin.googleapis.com/Instance",
+		"resource.name": "forbidden-my-sql-instance",
+		"resource.labels": map[string]string{
+			"env": "prod",
+		},
+	}
+	for i := 0; i < 10; i++ {
+		decisions, err := engine.EvalAll(input)
+		if err != nil {
+			t.Fatal(err)
 		}
-		l := lbls.(map[string]string)
-		for k, v := range s.LabelValues {
-			lv, found := l[k]
-			if !found || lv != v {
-				return false
+		var instNames []string
+		for _, dec := range decisions {
+			for _, val := range dec.(*model.ListDecisionValue).Values() {
+				v, err := val.ConvertToNative(reflect.TypeOf(violation{}))
+				if err != nil {
+					t.Fatal(err)
+				}
+				instNames = append(instNames, v.(violation).Details.Instance)
 			}
 		}
+		if len(decisions) != 1 {
+			t.Fatalf("got %v, wanted a single merged decision", decisions)
+		}
+		if !reflect.DeepEqual(instNames, []string{"alpha", "bravo", "charlie"}) {
+			t.Fatalf("got instance order %v, wanted [alpha bravo charlie]", instNames)
+		}
+	}
+}
+
+func TestEngine_MixedKeyRangeOrder(t *testing.T) {
+	engine, _ := newTestEngine(t, "sensitive_data")
+	tmpl, iss := engine.CompileTemplate(model.StringSource(`
+apiVersion: policy.acme.co/v1
+kind: PolicyTemplate
+metadata:
+  name: claim_keys
+evaluator:
+  ranges:
+    - {key: k, in: request.auth.claims}
+  productions:
+    - decision: policy.report
+      output: k
+`, "claim_keys.yaml"))
+	if iss.Err() != nil {
+		t.Fatal(iss.Err())
+	}
+	err := engine.SetTemplate(tmpl.Metadata.Name, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst, iss := engine.CompileInstance(model.StringSource(`
+apiVersion: policy.acme.co/v1
+kind: claim_keys
+metadata:
+  name: all_claims
+`, "all_claims.yaml"))
+	if iss.Err() != nil {
+		t.Fatal(iss.Err())
+	}
+	err = engine.AddInstance(inst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Dynamically typed maps may mix key types, which are ordered by type and then by value.
+	input := map[string]interface{}{
+		"request.auth.claims": map[interface{}]interface{}{
+			"b": 1, 2: 1, uint64(3): 1, "a": 1, true: 1, 1: 1, false: 1, uint64(1): 1,
+		},
+	}
+	want := []interface{}{false, true, int64(1), int64(2), uint64(1), uint64(3), "a", "b"}
+	for i := 0; i < 20; i++ {
+		decisions, err := engine.EvalAll(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(decisions) != 1 {
+			t.Fatalf("got %v, wanted a policy.report decision", decisions)
+		}
+		var got []interface{}
+		for _, val := range decisions[0].(*model.ListDecisionValue).Values() {
+			got = append(got, val.Value())
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got range order %v, wanted %v", got, want)
+		}
+	}
+}
+
+func TestEngine_AggregateAcrossInstances(t *testing.T) {
+	selected := 0
+	countingSelector := func(model.Selector, interpreter.Activation) bool {
+		selected++
 		return true
-	default:
-		// TODO: implement
-		return false
+	}
+	engine, inst := newTestEngine(t, "sensitive_data", Selectors(countingSelector))
+	for i := 0; i < 5; i++ {
+		named := *inst
+		named.Metadata = &model.InstanceMetadata{
+			Namespace: "acme",
+			Name:      fmt.Sprintf("secret_acme_resources_%d", i),
+		}
+		named.Selectors = []model.Selector{&model.LabelSelector{}}
+		err := engine.AddInstance(&named)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	input := map[string]interface{}{
+		"destination.ip":  "10.0.0.1",
+		"origin.ip":       "10.0.0.2",
+		"resource.name":   "/company/acme/secrets/doomsday-device",
+		"resource.labels": map[string]string{},
+	}
+	decisions, err := engine.EvalAll(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decisions) != 1 {
+		t.Fatalf("got %v, wanted a single merged decision", decisions)
+	}
+	if !decisions[0].IsFinal() || decisions[0].(*model.BoolDecisionValue).Value() != types.True {
+		t.Errorf("got %v, wanted final policy.deny: true", decisions[0])
+	}
+	if selected != 1 {
+		t.Errorf("got %d instances selected, wanted evaluation to stop after 1", selected)
+	}
+}
+
+func TestEngine_Parallel(t *testing.T) {
+	input := map[string]interface{}{
+		"resource.type":   "sqladmin.googleapis.com/Instance",
+		"resource.name":   "/company/acme/secrets/doomsday-device",
+		"resource.labels": map[string]string{"env": "prod"},
+		"destination.ip":  "10.0.0.1",
+		"origin.ip":       "10.0.0.2",
+	}
+	var want []string
+	for _, workers := range []int{1, 2, 8} {
+		engine, inst := newTestEngine(t, "resource_types", Parallelism(workers))
+		sensitive := addTestTemplate(t, engine, "sensitive_data")
+		for i := 0; i < 20; i++ {
+			err := engine.AddInstance(
+				labeledInstance(inst, fmt.Sprintf("types_%02d", 19-i), inst.Selectors...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = engine.AddInstance(
+				labeledInstance(sensitive, fmt.Sprintf("secrets_%02d", i), sensitive.Selectors...))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		decisions, trace, err := engine.EvalWithTrace(context.Background(), input, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(decisions) != 2 {
+			t.Fatalf("workers=%d: got %v, wanted a deny and a violation decision",
+				workers, decisions)
+		}
+		deny := decisions[1].(*model.BoolDecisionValue)
+		if !deny.IsFinal() || deny.Value() != types.True ||
+			deny.Source().InstanceName != "secrets_00" {
+			t.Errorf("workers=%d: got %v from %v, wanted final deny from secrets_00",
+				workers, deny, deny.Source())
+		}
+		got := violationInstances(decisions)
+		for _, it := range trace.Instances {
+			got = append(got, it.InstanceName)
+		}
+		if want == nil {
+			want = got
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("workers=%d: got %v, wanted %v", workers, got, want)
+		}
+	}
+
+	engine, inst := newTestEngine(t, "resource_types", Parallelism(4))
+	for i := 0; i < 20; i++ {
+		err := engine.AddInstance(labeledInstance(inst, fmt.Sprintf("types_%02d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := engine.EvalContext(ctx, input, nil)
+	if err != context.Canceled {
+		t.Errorf("got %v, wanted context.Canceled", err)
+	}
+}
+
+func TestEngine_RuleAggregator(t *testing.T) {
+	input := map[string]interface{}{
+		"resource.type":   "sqladmin.googleapis.com/Instance",
+		"resource.name":   "/company/acme/secrets/doomsday-device",
+		"resource.labels": map[string]string{"env": "prod"},
+	}
+	for _, workers := range []int{1, 4} {
+		engine, inst := newTestEngine(t, "resource_types", Parallelism(workers),
+			RuntimeTemplateOptions(runtime.DecisionAggregator("policy.violation",
+				&ruleAggregator{name: "policy.violation"})))
+		for i := 0; i < 2; i++ {
+			err := engine.AddInstance(labeledInstance(inst, fmt.Sprintf("types_%02d", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		decisions, err := engine.EvalAll(input)
+		if workers > 1 {
+			if err == nil || !strings.Contains(err.Error(), "does not implement Merger") {
+				t.Errorf("workers=%d: got %v, wanted merge error", workers, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(decisions) != 1 {
+			t.Fatalf("got %v, wanted a violation decision", decisions)
+		}
+		violations := decisions[0].(*model.ListDecisionValue)
+		if len(violations.Values()) != 2 {
+			t.Fatalf("got %v, wanted two violations", violations.Values())
+		}
+		for i, src := range violations.Sources() {
+			if src == nil || src.Rule == nil || src.InstanceName != "" {
+				t.Errorf("got source %v for violation %d, wanted a rule-only source", src, i)
+			}
+		}
+	}
+}
+
+// ruleAggregator collects values using only the Aggregator methods, which record the rule
+// rather than the full decision source, and does not support merging.
+type ruleAggregator struct {
+	name string
+}
+
+func (agg *ruleAggregator) DefaultDecision() model.DecisionValue {
+	return model.NewListDecisionValue(agg.name)
+}
+
+func (agg *ruleAggregator) Aggregate(prg cel.Program, vars interpreter.Activation,
+	prev model.DecisionValue, rule model.Rule) (model.DecisionValue, error) {
+	val, det, err := prg.Eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	prevList := prev.(*model.ListDecisionValue)
+	prevList.Append(val, det, rule)
+	return prevList, nil
+}
+
+func TestEngine_DecisionReferences(t *testing.T) {
+	input := map[string]interface{}{
+		"resource.type":   "sqladmin.googleapis.com/Instance",
+		"resource.name":   "forbidden-my-sql-instance",
+		"resource.labels": map[string]string{},
+	}
+	for _, workers := range []int{1, 4} {
+		engine, inst := newTestEngine(t, "decision_refs", Parallelism(workers))
+		for _, name := range []string{"refs_a", "refs_b"} {
+			err := engine.AddInstance(labeledInstance(inst, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		decisions, err := engine.EvalAll(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, dv := range decisions {
+			names = append(names, dv.Name())
+		}
+		wantNames := []string{"policy.report", "policy.deny", "policy.violation"}
+		if !reflect.DeepEqual(names, wantNames) {
+			t.Fatalf("workers=%d: got decisions %v, wanted %v", workers, names, wantNames)
+		}
+		deny := decisions[1].(*model.BoolDecisionValue)
+		if !deny.IsFinal() || deny.Value() != types.True ||
+			deny.Source().InstanceName != "refs_a" {
+			t.Errorf("workers=%d: got %v from %v, wanted final deny from refs_a",
+				workers, deny, deny.Source())
+		}
+		got := violationInstances(decisions)
+		want := []string{"refs_a", "refs_b", "refs_a", "refs_b"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("workers=%d: got instances %v, wanted %v", workers, got, want)
+		}
+
+		decisions, err = engine.Eval(input, DecisionNames("policy.violation"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(decisions) != 1 || decisions[0].Name() != "policy.violation" {
+			t.Errorf("workers=%d: got %v, wanted only policy.violation", workers, decisions)
+		}
+	}
+}
+
+func TestEngine_CombiningAggregators(t *testing.T) {
+	aggs := RuntimeTemplateOptions(
+		runtime.NewFirstApplicableAggregator("access.first"),
+		runtime.NewDenyOverridesAggregator("access.deny_overrides"),
+		runtime.NewPermitOverridesAggregator("access.permit_overrides"),
+		runtime.NewPriorityAggregator("access.priority"),
+		runtime.NewMinAggregator("access.min"),
+		runtime.NewMaxAggregator("access.max"),
+		runtime.NewSumAggregator("access.sum"),
+		runtime.NewCountAggregator("access.count"),
+	)
+	tests := []struct {
+		resource string
+		values   map[string]interface{}
+		final    []string
+	}{
+		{
+			resource: "/public/docs/readme",
+			values: map[string]interface{}{
+				"access.first":            "allow-public",
+				"access.deny_overrides":   "deny-all",
+				"access.permit_overrides": "allow-public",
+				"access.priority":         "allow-docs",
+				"access.min":              int64(1),
+				"access.max":              int64(10),
+				"access.sum":              int64(16),
+				"access.count":            int64(3),
+			},
+			final: []string{"access.first", "access.deny_overrides", "access.permit_overrides"},
+		},
+		{
+			resource: "/private/plans",
+			values: map[string]interface{}{
+				"access.first":            "deny-all",
+				"access.deny_overrides":   "deny-all",
+				"access.permit_overrides": "deny-all",
+				"access.priority":         "deny-all",
+				"access.min":              int64(5),
+				"access.max":              int64(5),
+				"access.sum":              int64(5),
+				"access.count":            int64(1),
+			},
+			final: []string{"access.first", "access.deny_overrides"},
+		},
+	}
+	for _, workers := range []int{1, 4} {
+		// Split the rules across two instances to exercise the merging of parallel evaluations.
+		engine, inst := newTestEngine(t, "combining",
+			aggs, EvaluatorDecisionLimit(4), Parallelism(workers))
+		first := labeledInstance(inst, "access_a")
+		first.Rules = inst.Rules[:2]
+		second := labeledInstance(inst, "access_b")
+		second.Rules = inst.Rules[2:]
+		for _, i := range []*model.Instance{first, second} {
+			err := engine.AddInstance(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, tst := range tests {
+			decisions, err := engine.EvalAll(map[string]interface{}{
+				"resource.name":   tst.resource,
+				"resource.labels": map[string]string{},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			values := map[string]interface{}{}
+			var final []string
+			for _, dv := range decisions {
+				val := dv.(model.SingleDecisionValue).Value()
+				if m, ok := val.(traits.Mapper); ok {
+					val = m.Get(types.String("rule"))
+				}
+				values[dv.Name()] = val.Value()
+				if dv.IsFinal() {
+					final = append(final, dv.Name())
+				}
+			}
+			if !reflect.DeepEqual(values, tst.values) {
+				t.Errorf("workers=%d, resource=%s: got %v, wanted %v",
+					workers, tst.resource, values, tst.values)
+			}
+			if !reflect.DeepEqual(final, tst.final) {
+				t.Errorf("workers=%d, resource=%s: got final decisions %v, wanted %v",
+					workers, tst.resource, final, tst.final)
+			}
+		}
+	}
+}
+
+func TestEngine_DeclaredDecisions(t *testing.T) {
+	// The aggregators are configured from the template decision declarations, and the test
+	// engine's OR aggregator for 'policy.deny' agrees with the declared aggregation.
+	engine, inst := newTestEngine(t, "declared_decisions", EvaluatorDecisionLimit(4))
+	err := engine.AddInstance(inst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decisions, err := engine.EvalAll(map[string]interface{}{
+		"resource.name":   "/public/docs/readme",
+		"resource.labels": map[string]string{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]interface{}{}
+	for _, dv := range decisions {
+		switch v := dv.(type) {
+		case *model.ListDecisionValue:
+			var vals []interface{}
+			for _, val := range v.Values() {
+				vals = append(vals, val.Value())
+			}
+			values[dv.Name()] = vals
+		case model.SingleDecisionValue:
+			val := v.Value()
+			if m, ok := val.(traits.Mapper); ok {
+				val = m.Get(types.String("rule"))
+			}
+			values[dv.Name()] = val.Value()
+		}
+	}
+	want := map[string]interface{}{
+		"policy.deny":         true,
+		"access.effect":       "deny-all",
+		"access.max_priority": int64(10),
+		"access.rules":        []interface{}{"allow-public", "deny-all", "allow-docs"},
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("got %v, wanted %v", values, want)
+	}
+
+	// Aggregators configured in Go must agree with the declared aggregation.
+	engine, _ = newTestEngine(t, "greeting", EvaluatorDecisionLimit(4),
+		TemplateRuntimeOptions("declared_decisions",
+			runtime.NewCollectAggregator("access.max_priority")))
+	tr := test.NewReader("../test/testdata")
+	tmplSrc, _ := tr.Read("../test/testdata/declared_decisions/template.yaml")
+	tmpl, iss := engine.CompileTemplate(tmplSrc)
+	if iss.Err() != nil {
+		t.Fatal(iss.Err())
+	}
+	err = engine.SetTemplate(tmpl.Metadata.Name, tmpl)
+	wantErr := "decision access.max_priority: configured aggregator *runtime.CollectAggregator " +
+		"conflicts with declared aggregation: max"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("got error %v, wanted %s", err, wantErr)
+	}
+}
+
+func TestEngine_DeclaredDecisionReferences(t *testing.T) {
+	engine, _ := newTestEngine(t, "sensitive_data")
+	tmpl, iss := engine.CompileTemplate(model.StringSource(`
+apiVersion: policy.acme.co/v1
+kind: PolicyTemplate
+metadata:
+  name: typed_refs
+decisions:
+  policy.deny:
+    aggregate: or
+    schema:
+      type: boolean
+  policy.report:
+    schema:
+      type: string
+evaluator:
+  productions:
+    - decisionRef: "'policy.' + resource.type"
+      output: resource.name
+`, "typed_refs.yaml"))
+	if iss.Err() != nil {
+		t.Fatal(iss.Err())
+	}
+	err := engine.SetTemplate(tmpl.Metadata.Name, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst, iss := engine.CompileInstance(model.StringSource(`
+apiVersion: policy.acme.co/v1
+kind: typed_refs
+metadata:
+  name: resource_refs
+`, "resource_refs.yaml"))
+	if iss.Err() != nil {
+		t.Fatal(iss.Err())
+	}
+	err = engine.AddInstance(inst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decisions, err := engine.EvalAll(map[string]interface{}{
+		"resource.type": "report",
+		"resource.name": "/company/acme/secrets/doomsday-device",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decisions) != 1 || decisions[0].Name() != "policy.report" {
+		t.Errorf("got %v, wanted a policy.report decision", decisions)
+	}
+	// The output of a computed reference is checked against the declared decision type once the
+	// reference has been evaluated.
+	_, err = engine.EvalAll(map[string]interface{}{
+		"resource.type": "deny",
+		"resource.name": "/company/acme/secrets/doomsday-device",
+	})
+	if err == nil || !strings.Contains(err.Error(),
+		`expected bool output for decision policy.deny, found: "/company/acme/secrets/doomsday-device"`) {
+		t.Errorf("got %v, wanted an output type error", err)
+	}
+}
+
+func TestEngine_ConflictingDecisions(t *testing.T) {
+	countTemplate := func(decl string) *model.Source {
+		return model.StringSource(`
+apiVersion: policy.acme.co/v1
+kind: PolicyTemplate
+metadata:
+  name: rule_counts
+`+decl+`
+evaluator:
+  productions:
+    - decision: access.rules
+      output: resource.name
+`, "rule_counts.yaml")
+	}
+	engine, inst := newTestEngine(t, "declared_decisions", EvaluatorDecisionLimit(4),
+		TemplateRuntimeOptions("rule_counts", runtime.NewCountAggregator("access.rules")))
+	err := engine.AddInstance(inst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := countTemplate(`
+decisions:
+  access.rules:
+    aggregate: count
+    schema:
+      type: string`)
+	tmpl, iss := engine.CompileTemplate(src)
+	if iss.Err() != nil {
+		t.Fatal(iss.Err())
+	}
+	err = engine.SetTemplate(tmpl.Metadata.Name, tmpl)
+	wantErr := "decision access.rules: declared aggregation count conflicts with template " +
+		"declared_decisions aggregation: collect"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("got error %v, wanted %s", err, wantErr)
+	}
+
+	// Aggregators configured in Go are not declared, so the conflict is reported when the
+	// decision values are combined during evaluation.
+	src = countTemplate("")
+	tmpl, iss = engine.CompileTemplate(src)
+	if iss.Err() != nil {
+		t.Fatal(iss.Err())
+	}
+	err = engine.SetTemplate(tmpl.Metadata.Name, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts, iss := engine.CompileInstance(model.StringSource(`
+apiVersion: policy.acme.co/v1
+kind: rule_counts
+metadata:
+  name: all_rules
+`, "all_rules.yaml"))
+	if iss.Err() != nil {
+		t.Fatal(iss.Err())
+	}
+	err = engine.AddInstance(counts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = engine.EvalAll(map[string]interface{}{
+		"resource.name":   "/public/docs/readme",
+		"resource.labels": map[string]string{},
+	})
+	if err == nil || !strings.Contains(err.Error(),
+		"decision access.rules: got *model.ListDecisionValue, wanted *model.ValueDecisionValue") {
+		t.Errorf("got %v, wanted a decision type error", err)
+	}
+}
+
+func TestEngine_FinalizationScopes(t *testing.T) {
+	want := map[string]interface{}{
+		"policy.deny": true,
+		// The first violation of each rule within each instance.
+		"access.violation": []interface{}{
+			"docs:/public/", "all:/", "docs:/public/", "all:/",
+		},
+		// The first rule name within each instance.
+		"access.instance_first": []interface{}{"docs", "docs"},
+		// The first rule name within the policy set.
+		"access.first": []interface{}{"docs"},
+	}
+	for _, workers := range []int{1, 4} {
+		engine, inst := newTestEngine(t, "finalization_scopes", Parallelism(workers))
+		for _, name := range []string{"prefix_rules_a", "prefix_rules_b"} {
+			err := engine.AddInstance(labeledInstance(inst, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		decisions, err := engine.EvalAll(map[string]interface{}{
+			"resource.name":   "/public/docs/readme",
+			"resource.labels": map[string]string{},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := map[string]interface{}{}
+		for _, dv := range decisions {
+			switch v := dv.(type) {
+			case *model.BoolDecisionValue:
+				values[dv.Name()] = v.Value().Value()
+			case *model.ListDecisionValue:
+				vals := []interface{}{}
+				for _, val := range v.Values() {
+					if m, ok := val.(traits.Mapper); ok {
+						vals = append(vals, fmt.Sprintf("%v:%v",
+							m.Get(types.String("rule")), m.Get(types.String("prefix"))))
+						continue
+					}
+					vals = append(vals, val.Value())
+				}
+				values[dv.Name()] = vals
+			}
+		}
+		if !reflect.DeepEqual(values, want) {
+			t.Errorf("workers=%d: got %v, wanted %v", workers, values, want)
+		}
+	}
+
+	// Finalization scopes configured in Go must agree with the declared scope.
+	engine, _ := newTestEngine(t, "greeting", EvaluatorDecisionLimit(4),
+		TemplateRuntimeOptions("finalization_scopes",
+			runtime.DecisionFinalization("access.violation", runtime.InstanceScope)))
+	tr := test.NewReader("../test/testdata")
+	tmplSrc, _ := tr.Read("../test/testdata/finalization_scopes/template.yaml")
+	tmpl, iss := engine.CompileTemplate(tmplSrc)
+	if iss.Err() != nil {
+		t.Fatal(iss.Err())
+	}
+	err := engine.SetTemplate(tmpl.Metadata.Name, tmpl)
+	wantErr := "decision access.violation: configured finalization scope instance " +
+		"conflicts with declared scope: rule"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("got error %v, wanted %s", err, wantErr)
+	}
+}
+
+func TestEngine_EvalErrors(t *testing.T) {
+	// The resource.type is missing, so the resource_types template fails for every instance.
+	input := map[string]interface{}{
+		"destination.ip":  "10.0.0.1",
+		"origin.ip":       "10.0.0.2",
+		"resource.name":   "/company/acme/secrets/doomsday-device",
+		"resource.labels": map[string]string{"env": "prod"},
+	}
+	newEngine := func(opts ...EngineOption) *Engine {
+		engine, inst := newTestEngine(t, "resource_types", opts...)
+		sensitive := addTestTemplate(t, engine, "sensitive_data")
+		for _, i := range []*model.Instance{
+			labeledInstance(inst, "types_a"),
+			labeledInstance(inst, "types_b"),
+			labeledInstance(sensitive, "secrets"),
+		} {
+			err := engine.AddInstance(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return engine
+	}
+
+	decisions, err := newEngine().EvalAll(input)
+	if decisions != nil {
+		t.Errorf("got %v, wanted no decisions", decisions)
+	}
+	errs, ok := err.(runtime.EvalErrors)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("got %v, wanted the term and match errors of one instance", err)
+	}
+	tests := []struct {
+		kind runtime.ErrorKind
+		name string
+		line int
+	}{
+		{kind: runtime.TermError, name: "matches_resource_type", line: 43},
+		{kind: runtime.MatchError, line: 46},
+	}
+	for i, tst := range tests {
+		e := errs[i]
+		if e.Kind != tst.kind || e.Name != tst.name || e.Location.Line() != tst.line {
+			t.Errorf("got %s %s at line %d, wanted %s %s at line %d",
+				e.Kind, e.Name, e.Location.Line(), tst.kind, tst.name, tst.line)
+		}
+		if e.Source.InstanceName != "types_a" || e.Source.RuleLocation.Line() != 24 {
+			t.Errorf("got error source %v, wanted the types_a rule at line 24", e.Source)
+		}
+		if !strings.HasPrefix(e.Error(), "resource_types/acme/types_a") ||
+			!strings.Contains(e.Error(), "no such attribute") {
+			t.Errorf("got error message %q", e.Error())
+		}
+	}
+
+	for _, workers := range []int{1, 4} {
+		decisions, err := newEngine(ContinueOnError(), Parallelism(workers)).EvalAll(input)
+		errs, ok := err.(runtime.EvalErrors)
+		if !ok || len(errs) != 4 {
+			t.Fatalf("workers=%d: got %v, wanted the errors of both types instances",
+				workers, err)
+		}
+		if errs[0].Source.InstanceName != "types_a" || errs[2].Source.InstanceName != "types_b" {
+			t.Errorf("workers=%d: got errors %v, wanted errors in instance order", workers, errs)
+		}
+		if len(decisions) != 1 || decisions[0].Name() != "policy.deny" {
+			t.Errorf("workers=%d: got %v, wanted the policy.deny decision", workers, decisions)
+		}
+	}
+}
+
+func TestEngine_ErrorDisposition(t *testing.T) {
+	// The origin.ip is missing, so the sensitive_data match fails to evaluate.
+	input := map[string]interface{}{
+		"destination.ip":  "10.0.0.1",
+		"resource.name":   "/company/acme/secrets/doomsday-device",
+		"resource.labels": map[string]string{},
+	}
+	tests := []struct {
+		name string
+		disp *runtime.ErrorDisposition
+		deny ref.Val
+		err  bool
+	}{
+		{name: "default", err: true},
+		{name: "surface", disp: runtime.SurfaceError(), err: true},
+		{name: "skip", disp: runtime.SkipError()},
+		{name: "fail_closed", disp: runtime.ErrorValue(true), deny: types.True},
+	}
+	for _, tc := range tests {
+		tst := tc
+		t.Run(tst.name, func(tt *testing.T) {
+			var opts []EngineOption
+			if tst.disp != nil {
+				opts = append(opts, TemplateRuntimeOptions("sensitive_data",
+					runtime.DecisionErrorDisposition("policy.deny", tst.disp)))
+			}
+			engine, inst := newTestEngine(tt, "sensitive_data", opts...)
+			err := engine.AddInstance(inst)
+			if err != nil {
+				tt.Fatal(err)
+			}
+			decisions, err := engine.EvalAll(input)
+			if (err != nil) != tst.err {
+				tt.Fatalf("got error %v, wanted error: %v", err, tst.err)
+			}
+			if tst.deny == nil {
+				if len(decisions) != 0 {
+					tt.Errorf("got %v, wanted no decisions", decisions)
+				}
+				return
+			}
+			if len(decisions) != 1 {
+				tt.Fatalf("got %v, wanted a policy.deny decision", decisions)
+			}
+			deny := decisions[0].(*model.BoolDecisionValue)
+			if !deny.IsFinal() || deny.Value() != tst.deny ||
+				deny.Source().InstanceName != "secret_acme_resources" {
+				tt.Errorf("got %v from %v, wanted final deny %v", deny, deny.Source(), tst.deny)
+			}
+		})
+	}
+}
+
+func TestEngine_EvalPartial(t *testing.T) {
+	engine, inst := newTestEngine(t, "sensitive_data", PartialEval())
+	err := engine.AddInstance(inst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := map[string]interface{}{
+		"destination.ip":  "10.0.0.1",
+		"resource.name":   "/company/acme/secrets/doomsday-device",
+		"resource.labels": map[string]string{},
+	}
+	decisions, residuals, err := engine.EvalPartial(context.Background(), input, nil,
+		cel.AttributePattern("origin.ip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decisions) != 1 {
+		t.Fatalf("got %v, wanted a single decision", decisions)
+	}
+	deny := decisions[0].(*model.BoolDecisionValue)
+	if deny.IsFinal() || !types.IsUnknown(deny.Value()) {
+		t.Errorf("got %v, wanted an unknown, non-final decision", deny)
+	}
+	if len(residuals) != 1 {
+		t.Fatalf("got %v, wanted a single residual", residuals)
+	}
+	res := residuals[0]
+	if res.Decision != "policy.deny" || res.Source.InstanceName != inst.Metadata.Name {
+		t.Errorf("got residual for %s from %v, wanted policy.deny from %s",
+			res.Decision, res.Source, inst.Metadata.Name)
+	}
+	if !reflect.DeepEqual(res.Attributes, []string{"origin.ip"}) {
+		t.Errorf("got attributes %v, wanted [origin.ip]", res.Attributes)
+	}
+	if res.Match != "different_locations" || res.Output != "true" {
+		t.Errorf("got residual match %q and output %q, wanted different_locations and true",
+			res.Match, res.Output)
+	}
+	wantTerms := map[string]string{
+		"different_locations": `locationCode(origin.ip) != "us"`,
+	}
+	if !reflect.DeepEqual(res.Terms, wantTerms) {
+		t.Errorf("got residual terms %v, wanted %v", res.Terms, wantTerms)
+	}
+
+	// Once the attribute is known, the decision is final and there are no residuals.
+	input["origin.ip"] = "10.0.0.2"
+	decisions, residuals, err = engine.EvalPartial(context.Background(), input, nil,
+		cel.AttributePattern("origin.ip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(residuals) != 1 {
+		t.Errorf("got %v, wanted the residual to remain while the attribute is unknown", residuals)
+	}
+	decisions, residuals, err = engine.EvalPartial(context.Background(), input, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(residuals) != 0 || len(decisions) != 1 || !decisions[0].IsFinal() {
+		t.Errorf("got %v and residuals %v, wanted a final decision", decisions, residuals)
+	}
+
+	engine, _ = newTestEngine(t, "sensitive_data")
+	_, _, err = engine.EvalPartial(context.Background(), input, nil)
+	if err == nil {
+		t.Error("got nil, wanted an error when partial evaluation is not enabled")
+	}
+}
+
+func TestEngine_EvalPartialOutputs(t *testing.T) {
+	evals := 0
+	env, _ := cel.NewEnv(test.Decls)
+	engine, err := NewEngine(
+		StandardExprEnv(env),
+		PartialEval(),
+		RuntimeTemplateOptions(
+			runtime.Functions(&functions.Overload{
+				Operator: "location_code_string",
+				Unary: func(ip ref.Val) ref.Val {
+					evals++
+					return types.String("us")
+				},
+			}),
+			runtime.NewCollectAggregator("policy.report"),
+		),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl, iss := engine.CompileTemplate(model.StringSource(`
+apiVersion: policy.acme.co/v1
+kind: PolicyTemplate
+metadata:
+  name: locations
+evaluator:
+  productions:
+    - decision: policy.report
+      output: locationCode(destination.ip)
+`, "locations.yaml"))
+	if iss.Err() != nil {
+		t.Fatal(iss.Err())
+	}
+	err = engine.SetTemplate(tmpl.Metadata.Name, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst, iss := engine.CompileInstance(model.StringSource(`
+apiVersion: policy.acme.co/v1
+kind: locations
+metadata:
+  name: destinations
+`, "destinations.yaml"))
+	if iss.Err() != nil {
+		t.Fatal(iss.Err())
+	}
+	err = engine.AddInstance(inst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decisions, residuals, err := engine.EvalPartial(context.Background(),
+		map[string]interface{}{"destination.ip": "10.0.0.1"}, nil,
+		cel.AttributePattern("origin.ip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decisions) != 1 || len(residuals) != 0 {
+		t.Fatalf("got %v and residuals %v, wanted a known policy.report", decisions, residuals)
+	}
+	// The output is evaluated once to check whether it is unknown, and the result is aggregated.
+	if evals != 1 {
+		t.Errorf("got %d output evaluations, wanted 1", evals)
+	}
+}
+
+func TestEngine_DecisionSources(t *testing.T) {
+	engine, inst := newTestEngine(t, "resource_types")
+	for _, name := range []string{"alpha", "bravo"} {
+		named := *inst
+		named.Metadata = &model.InstanceMetadata{Namespace: "acme", Name: name}
+		err := engine.AddInstance(&named)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	decisions, err := engine.EvalAll(map[string]interface{}{
+		"resource.type": "sqladmin.googleapis.com/Instance",
+		"resource.name": "forbidden-my-sql-instance",
+		"resource.labels": map[string]string{
+			"env": "prod",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decisions) != 1 {
+		t.Fatalf("got %v, wanted a single decision", decisions)
+	}
+	multi := decisions[0].(model.MultiDecisionValue)
+	srcs := multi.Sources()
+	if len(srcs) != 2 {
+		t.Fatalf("got %d sources, wanted 2", len(srcs))
+	}
+	for i, name := range []string{"alpha", "bravo"} {
+		src := srcs[i]
+		if src.Template != "resource_types" ||
+			src.InstanceNamespace != "acme" ||
+			src.InstanceName != name {
+			t.Errorf("got source %v, wanted resource_types/acme/%s", src, name)
+		}
+		if src.RuleID() != multi.RuleIDs()[i] {
+			t.Errorf("got rule id %d, wanted %d", src.RuleID(), multi.RuleIDs()[i])
+		}
+		if src.InstanceSource != "../test/testdata/resource_types/instance.yaml" ||
+			src.RuleLocation.Line() != 24 {
+			t.Errorf("got rule location %s:%d, wanted instance.yaml:24",
+				src.InstanceSource, src.RuleLocation.Line())
+		}
+		if src.ProductionLocation.Line() != 46 {
+			t.Errorf("got production location line %d, wanted 46",
+				src.ProductionLocation.Line())
+		}
+	}
+}
+
+func TestEngine_EvalWithTrace(t *testing.T) {
+	engine, inst := newTestEngine(t, "resource_types")
+	err := engine.AddInstance(inst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := map[string]interface{}{
+		"resource.type": "sqladmin.googleapis.com/Instance",
+		"resource.name": "forbidden-my-sql-instance",
+		"resource.labels": map[string]string{
+			"env": "prod",
+		},
+	}
+	evalCost := func(traced bool) int64 {
+		t.Helper()
+		ev, err := engine.newEvaluation(context.Background(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if traced {
+			ev.EnableTrace()
+		}
+		_, err = engine.evalInternal(ev, input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ev.Cost()
+	}
+	// Tracing records the decision outputs evaluated by the aggregators rather than evaluating
+	// them again.
+	if traced, untraced := evalCost(true), evalCost(false); traced != untraced {
+		t.Errorf("got traced cost %d, wanted %d", traced, untraced)
+	}
+	decisions, trace, err := engine.EvalWithTrace(context.Background(), input, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decisions) != 1 {
+		t.Fatalf("got %v, wanted a single decision", decisions)
+	}
+	if len(trace.Instances) != 1 || len(trace.Instances[0].Rules) != 1 {
+		t.Fatalf("got trace %v, wanted one instance with one rule", trace)
+	}
+	instTrace := trace.Instances[0]
+	if instTrace.Template != "resource_types" ||
+		instTrace.InstanceName != "restricted_resource_types" {
+		t.Errorf("got instance trace %s/%s, wanted resource_types/restricted_resource_types",
+			instTrace.Template, instTrace.InstanceName)
+	}
+	ruleTrace := instTrace.Rules[0]
+	if ruleTrace.RuleID() != inst.Rules[0].GetID() || len(ruleTrace.Iterations) != 1 {
+		t.Fatalf("got rule trace %v, wanted rule %d with one iteration",
+			ruleTrace, inst.Rules[0].GetID())
+	}
+	iter := ruleTrace.Iterations[0]
+	if iter.Terms["matches_resource_type"] != types.True {
+		t.Errorf("got terms %v, wanted matches_resource_type=true", iter.Terms)
+	}
+	if len(iter.Productions) != 1 || iter.Productions[0].Match != types.True {
+		t.Fatalf("got productions %v, wanted a single matching production", iter.Productions)
+	}
+	decs := iter.Productions[0].Decisions
+	if len(decs) != 1 || decs[0].Name != "policy.violation" || decs[0].Err != nil {
+		t.Fatalf("got decisions %v, wanted a single policy.violation", decs)
+	}
+	violations := decisions[0].(*model.ListDecisionValue).Values()
+	if len(violations) != 1 || decs[0].Output != violations[0] {
+		t.Errorf("got traced output %v, wanted the aggregated violation %v",
+			decs[0].Output, violations)
+	}
+	text := trace.String()
+	for _, want := range []string{
+		"instance resource_types/acme/restricted_resource_types",
+		"term matches_resource_type = true",
+		"match = true",
+		`"message": "forbidden-my-sql-instance is in violation."`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("got trace text %q, wanted it to contain %q", text, want)
+		}
+	}
+}
+
+func TestEngine_RuleTerms(t *testing.T) {
+	engine, inst := newTestEngine(t, "greeting", EvaluatorDecisionLimit(4))
+	err := engine.AddInstance(inst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := map[string]interface{}{
+		"resource.labels": map[string]string{"env": "prod", "debug": "false"},
+	}
+	evalCost := func() ([]model.DecisionValue, int64) {
+		t.Helper()
+		ev, err := engine.newEvaluation(context.Background(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decisions, err := engine.evalInternal(ev, input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return decisions, ev.Cost()
+	}
+	// The greeting terms only depend on the rule, so they are evaluated when the instance is
+	// added rather than on each evaluation.
+	prepared, preparedCost := evalCost()
+	rt := engine.runtimes["greeting"]
+	rt.ReleaseInstance(inst)
+	released, releasedCost := evalCost()
+	if !reflect.DeepEqual(prepared, released) {
+		t.Errorf("got decisions %v with rule terms, wanted %v", prepared, released)
+	}
+	if preparedCost >= releasedCost {
+		t.Errorf("got cost %d with rule terms, wanted less than %d", preparedCost, releasedCost)
+	}
+
+	// Preparation stops once the cost limit is exceeded, and the remaining terms are evaluated
+	// with the instance.
+	ev := runtime.NewEvaluation(context.Background(), nil)
+	ev.SetCostLimit(1)
+	rt.PrepareInstance(ev, inst)
+	if _, isLimit := ev.Err().(*runtime.CostLimitError); !isLimit || ev.Cost() != 2 {
+		t.Errorf("got %v at cost %d, wanted the preparation to stop at the limit",
+			ev.Err(), ev.Cost())
+	}
+	limited, limitedCost := evalCost()
+	if !reflect.DeepEqual(limited, prepared) ||
+		limitedCost <= preparedCost || limitedCost >= releasedCost {
+		t.Errorf("got decisions %v at cost %d, wanted %v at a cost between %d and %d",
+			limited, limitedCost, prepared, preparedCost, releasedCost)
+	}
+	rt.ReleaseInstance(inst)
+
+	// Replacing the template prepares the configured instances for the new runtime.
+	tmpl, _ := engine.FindTemplate("greeting")
+	err = engine.SetTemplate("greeting", tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replaced, replacedCost := evalCost()
+	if !reflect.DeepEqual(replaced, prepared) || replacedCost != preparedCost {
+		t.Errorf("got decisions %v at cost %d, wanted %v at cost %d",
+			replaced, replacedCost, prepared, preparedCost)
+	}
+}
+
+func TestEngine_RuleTermsSetTemplateRace(t *testing.T) {
+	engine, inst := newTestEngine(t, "greeting", EvaluatorDecisionLimit(4))
+	err := engine.AddInstance(inst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Other instances lengthen the preparation of each runtime, during which the replacements
+	// race with SetTemplate.
+	for i := 0; i < 50; i++ {
+		other := *inst
+		other.Metadata = &model.InstanceMetadata{Name: fmt.Sprintf("other_%d", i)}
+		if err := engine.AddInstance(&other); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tmpl, _ := engine.FindTemplate("greeting")
+	done := make(chan struct{})
+	replaced := make(chan []*model.Instance)
+	go func() {
+		insts := []*model.Instance{inst}
+		for {
+			select {
+			case <-done:
+				replaced <- insts
+				return
+			default:
+			}
+			cpy := *inst
+			insts = append(insts, &cpy)
+			if err := engine.ReplaceInstance(&cpy); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		if err := engine.SetTemplate("greeting", tmpl); err != nil {
+			t.Error(err)
+		}
+	}
+	close(done)
+	insts := <-replaced
+	// Only the last replacement remains configured, so only its terms may be retained by the
+	// current runtime.
+	rt := engine.runtimes["greeting"]
+	last := insts[len(insts)-1]
+	if !rt.IsPrepared(last) {
+		t.Error("got the configured instance unprepared, wanted it prepared")
+	}
+	for _, prev := range insts[:len(insts)-1] {
+		if rt.IsPrepared(prev) {
+			t.Errorf("got replaced instance %p prepared, wanted it released", prev)
+		}
+	}
+}
+
+func TestEngine_InputTerms(t *testing.T) {
+	input := map[string]interface{}{
+		"destination.ip":  "10.0.0.1",
+		"origin.ip":       "10.0.0.1",
+		"resource.name":   "/company/acme/secrets/doomsday-device",
+		"resource.labels": map[string]string{},
+	}
+	for _, workers := range []int{1, 4} {
+		engine, inst := newTestEngine(t, "sensitive_data", Parallelism(workers))
+		evalCost := func() (*runtime.Trace, int64) {
+			t.Helper()
+			ev, err := engine.newEvaluation(context.Background(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ev.EnableTrace()
+			_, err = engine.evalInternal(ev, input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ev.Trace(), ev.Cost()
+		}
+		err := engine.AddInstance(labeledInstance(inst, "secrets_00"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, singleCost := evalCost()
+		for i := 1; i < 4; i++ {
+			err = engine.AddInstance(labeledInstance(inst, fmt.Sprintf("secrets_%02d", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		trace, cost := evalCost()
+		// The different_locations term only depends on the input, so it is evaluated once and
+		// shared by the instances evaluated afterward, which only pay for their match.
+		if workers == 1 && cost != singleCost+3 {
+			t.Errorf("got cost %d, wanted %d", cost, singleCost+3)
+		}
+		if len(trace.Instances) != 4 {
+			t.Fatalf("workers=%d: got %d instance traces, wanted 4", workers, len(trace.Instances))
+		}
+		for _, it := range trace.Instances {
+			terms := it.Rules[0].Iterations[0].Terms
+			if terms["different_locations"] != types.False {
+				t.Errorf("workers=%d: got terms %v for instance %s, wanted different_locations=false",
+					workers, terms, it.InstanceName)
+			}
+		}
+	}
+}
+
+func TestEngine_EnforcementAction(t *testing.T) {
+	input := map[string]interface{}{
+		"destination.ip":  "10.0.0.1",
+		"origin.ip":       "10.0.0.2",
+		"resource.name":   "/company/acme/secrets/doomsday-device",
+		"resource.labels": map[string]string{},
+	}
+	for _, workers := range []int{1, 4} {
+		engine, inst := newTestEngine(t, "sensitive_data", Parallelism(workers))
+		if inst.EnforcementAction != model.EnforcementDeny {
+			t.Fatalf("got enforcement action %q, wanted deny by default", inst.EnforcementAction)
+		}
+		for _, action := range []string{model.EnforcementDryRun, model.EnforcementWarn} {
+			adv := labeledInstance(inst, "secrets_"+action)
+			adv.EnforcementAction = action
+			err := engine.AddInstance(adv)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Advisory instances never contribute to the enforced decisions.
+		decisions, err := engine.EvalAll(input)
+		if err != nil || len(decisions) != 0 {
+			t.Fatalf("workers=%d: got %v, %v, wanted no enforced decisions",
+				workers, decisions, err)
+		}
+		err = engine.AddInstance(labeledInstance(inst, "secrets_deny"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		decisions, advisories, err := engine.EvalAdvisory(context.Background(), input, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(decisions) != 1 ||
+			decisions[0].(*model.BoolDecisionValue).Source().InstanceName != "secrets_deny" {
+			t.Errorf("workers=%d: got %v, wanted a deny from secrets_deny", workers, decisions)
+		}
+		if len(advisories) != 2 {
+			t.Fatalf("workers=%d: got %d advisories, wanted warn and dryrun",
+				workers, len(advisories))
+		}
+		for i, action := range []string{model.EnforcementWarn, model.EnforcementDryRun} {
+			adv := advisories[i]
+			if adv.EnforcementAction != action || adv.Err != nil || len(adv.Decisions) != 1 {
+				t.Fatalf("workers=%d: got advisory %v, wanted a %s decision", workers, adv, action)
+			}
+			deny := adv.Decisions[0].(*model.BoolDecisionValue)
+			if deny.Value() != types.True || deny.Source().InstanceName != "secrets_"+action {
+				t.Errorf("workers=%d: got %v from %v, wanted deny from secrets_%s",
+					workers, deny, deny.Source(), action)
+			}
+		}
+
+		// Batches only evaluate the advisory instances when requested.
+		for _, opts := range [][]EvalOption{nil, {IncludeAdvisories()}} {
+			var results []*BatchResult
+			err = engine.EvalBatch(context.Background(),
+				SliceInputs([]map[string]interface{}{input}), nil,
+				func(res *BatchResult) error {
+					results = append(results, res)
+					return nil
+				}, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := 2 * len(opts)
+			if len(results) != 1 || len(results[0].Decisions) != 1 ||
+				len(results[0].Advisories) != want {
+				t.Errorf("workers=%d, opts=%d: got %v, wanted a deny with %d advisories",
+					workers, len(opts), results, want)
+			}
+		}
+
+		// Advisory failures are reported separately from the enforced decisions.
+		engine.RemoveInstance("sensitive_data", "acme", "secrets_deny")
+		failing := map[string]interface{}{
+			"destination.ip":  "10.0.0.1",
+			"resource.name":   "/company/acme/secrets/doomsday-device",
+			"resource.labels": map[string]string{},
+		}
+		decisions, advisories, err = engine.EvalAdvisory(context.Background(), failing, nil)
+		if err != nil || len(decisions) != 0 {
+			t.Fatalf("workers=%d: got %v, %v, wanted no enforced decisions",
+				workers, decisions, err)
+		}
+		for _, adv := range advisories {
+			if _, ok := adv.Err.(runtime.EvalErrors); !ok {
+				t.Errorf("workers=%d: got %s advisory error %v, wanted runtime.EvalErrors",
+					workers, adv.EnforcementAction, adv.Err)
+			}
+		}
+	}
+}
+
+func TestEngine_CompileEnforcementAction(t *testing.T) {
+	engine, _ := newTestEngine(t, "sensitive_data")
+	inst, iss := engine.CompileInstance(model.StringSource(`
+apiVersion: policy.acme.co/v1
+kind: sensitive_data
+metadata:
+  name: secrets_rollout
+enforcementAction: dryrun
+rules:
+  - resource_prefixes: ["/company/acme/secrets/"]
+`, "rollout.yaml"))
+	if iss.Err() != nil {
+		t.Fatal(iss.Err())
+	}
+	if inst.EnforcementAction != model.EnforcementDryRun || !inst.IsAdvisory() {
+		t.Errorf("got enforcement action %q, wanted dryrun", inst.EnforcementAction)
+	}
+	_, iss = engine.CompileInstance(model.StringSource(`
+apiVersion: policy.acme.co/v1
+kind: sensitive_data
+metadata:
+  name: secrets_audit
+enforcementAction: audit
+`, "audit.yaml"))
+	if iss.Err() == nil || !strings.Contains(iss.Err().Error(), "invalid enum value: audit") {
+		t.Errorf("got %v, wanted an invalid enforcementAction", iss.Err())
+	}
+}
+
+func TestEngine_TimeWindow(t *testing.T) {
+	input := map[string]interface{}{
+		"resource.name": "/company/acme/legacy/accounts",
+	}
+	tests := []struct {
+		now    string
+		report string
+	}{
+		{now: "2020-05-31T23:59:59Z"},
+		{now: "2020-06-01T00:00:00Z", report: "exception granted"},
+		{now: "2020-08-15T00:00:00Z", report: "exception overdue for review"},
+		{now: "2020-09-01T00:00:00Z", report: "exception overdue for review"},
+		{now: "2020-09-01T00:00:01Z"},
+	}
+	for _, workers := range []int{1, 4} {
+		var now time.Time
+		clock := func() time.Time { return now }
+		engine, inst := newTestEngine(t, "temporary_exception", Clock(clock), Parallelism(workers))
+		err := engine.AddInstance(inst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tc := range tests {
+			now, _ = time.Parse(time.RFC3339, tc.now)
+			decisions, err := engine.EvalAll(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.report == "" {
+				if len(decisions) != 0 {
+					t.Errorf("workers=%d, now=%s: got %v, wanted the instance to be inactive",
+						workers, tc.now, decisions)
+				}
+				continue
+			}
+			if len(decisions) != 1 {
+				t.Fatalf("workers=%d, now=%s: got %v, wanted a policy.report decision",
+					workers, tc.now, decisions)
+			}
+			vals := decisions[0].(model.MultiDecisionValue).Values()
+			if len(vals) != 1 || vals[0] != types.String(tc.report) {
+				t.Errorf("workers=%d, now=%s: got report %v, wanted %s",
+					workers, tc.now, vals, tc.report)
+			}
+		}
+	}
+}
+
+// newTestEngine configures an engine with the standard test options and the env and template for
+// the given policy, and returns the compiled, but not yet added, policy instance.
+func newTestEngine(tb testing.TB, policy string, opts ...EngineOption) (*Engine, *model.Instance) {
+	tb.Helper()
+	env, _ := cel.NewEnv(test.Decls)
+	engOpts := []EngineOption{
+		StandardExprEnv(env),
+		Selectors(LabelSelector("resource.labels"), ExpressionSelector("resource.labels")),
+		RangeLimit(1),
+		RuntimeTemplateOptions(
+			runtime.Functions(test.Funcs...),
+			runtime.NewCollectAggregator("policy.violation"),
+			runtime.NewCollectAggregator("policy.report"),
+			runtime.NewOrAggregator("policy.deny"),
+		),
+	}
+	engOpts = append(engOpts, opts...)
+	engine, err := NewEngine(engOpts...)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return engine, addTestTemplate(tb, engine, policy)
+}
+
+// addTestTemplate configures the engine with the env and template for the given policy, and
+// returns the compiled, but not yet added, policy instance.
+func addTestTemplate(tb testing.TB, engine *Engine, policy string) *model.Instance {
+	tb.Helper()
+	tr := test.NewReader("../test/testdata")
+	envFile := fmt.Sprintf("../test/testdata/%s/env.yaml", policy)
+	envSrc, found := tr.Read(envFile)
+	if found {
+		mdlEnv, iss := engine.CompileEnv(envSrc)
+		if iss.Err() != nil {
+			tb.Fatal(iss.Err())
+		}
+		err := engine.SetEnv(mdlEnv.Name, mdlEnv)
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+	tmplFile := fmt.Sprintf("../test/testdata/%s/template.yaml", policy)
+	tmplSrc, _ := tr.Read(tmplFile)
+	tmpl, iss := engine.CompileTemplate(tmplSrc)
+	if iss.Err() != nil {
+		tb.Fatal(iss.Err())
+	}
+	err := engine.SetTemplate(tmpl.Metadata.Name, tmpl)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	instFile := fmt.Sprintf("../test/testdata/%s/instance.yaml", policy)
+	instSrc, _ := tr.Read(instFile)
+	inst, iss := engine.CompileInstance(instSrc)
+	if iss.Err() != nil {
+		tb.Fatal(iss.Err())
+	}
+	return inst
+}
+
+func decisionMatchesOutput(dec model.DecisionValue, out interface{}) (bool, error) {
+	switch dv := dec.(type) {
+	case *model.BoolDecisionValue:
+		ntv, err := dv.Value().ConvertToNative(reflect.TypeOf(out))
+		return err == nil && reflect.DeepEqual(ntv, out), nil
+	case *model.ListDecisionValue:
+		vals := dv.Values()
+		for _, val := range vals {
+			ntv, err := val.ConvertToNative(reflect.TypeOf(out))
+			if err == nil && reflect.DeepEqual(ntv, out) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func TestEngine_DeclaredNow(t *testing.T) {
+	engine, _ := newTestEngine(t, "temporary_exception")
+	_, iss := engine.CompileEnv(model.StringSource(`
+name: clock_env
+variables:
+  now:
+    type: string
+`, "clock_env.yaml"))
+	wantErr := "4:3: variable 'now' is reserved for the evaluation time and must be renamed"
+	if iss.Err() == nil || !strings.Contains(iss.Err().Error(), wantErr) {
+		t.Errorf("got error %v, wanted %s", iss.Err(), wantErr)
+	}
+
+	// Environments constructed directly are checked when templates refer to them.
+	env := model.NewEnv("clock_env")
+	env.Vars = append(env.Vars, model.NewVar("now", model.StringType))
+	err := engine.SetEnv(env.Name, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, iss = engine.CompileTemplate(model.StringSource(`
+apiVersion: policy.acme.co/v1
+kind: PolicyTemplate
+metadata:
+  name: clock_report
+evaluator:
+  environment: clock_env
+  productions:
+    - decision: policy.report
+      output: now
+`, "clock_report.yaml"))
+	wantErr = "7:16: environment clock_env declares variable 'now', which is reserved for the " +
+		"evaluation time"
+	if iss.Err() == nil || !strings.Contains(iss.Err().Error(), wantErr) {
+		t.Errorf("got error %v, wanted %s", iss.Err(), wantErr)
 	}
 }
@@ -0,0 +1,197 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policy
+
+import (
+	"sort"
+
+	"github.com/google/cel-policy-templates-go/policy/model"
+
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/traits"
+)
+
+// selectorIndex is an inverted index from label key-value pairs to the instances whose selectors
+// require the label pair in order to match.
+//
+// Each instance is indexed under a single label: either one of its 'matchLabels' pairs, or the
+// values of one of its 'In' expressions. Since an input may only have one value per label, an
+// instance appears at most once within the candidates for an input. Instances without such a
+// selector are always candidates.
+//
+// The index only prunes instances which cannot match. The candidates must still be checked
+// against all of their selectors.
+type selectorIndex struct {
+	postings  map[labelPair][]*model.Instance
+	pairs     map[*model.Instance][]labelPair
+	unindexed []*model.Instance
+}
+
+type labelPair struct {
+	label string
+	value string
+}
+
+func newSelectorIndex() *selectorIndex {
+	return &selectorIndex{
+		postings: map[labelPair][]*model.Instance{},
+		pairs:    map[*model.Instance][]labelPair{},
+	}
+}
+
+// add indexes the instance under the 'matchLabels' pair with the fewest indexed instances, or,
+// if there are no 'matchLabels' pairs, under the values of the first 'In' expression.
+func (idx *selectorIndex) add(inst *model.Instance) {
+	pairs := idx.indexPairs(inst)
+	if len(pairs) == 0 {
+		idx.unindexed = insertInstance(idx.unindexed, inst)
+		return
+	}
+	idx.pairs[inst] = pairs
+	for _, p := range pairs {
+		idx.postings[p] = insertInstance(idx.postings[p], inst)
+	}
+}
+
+// remove removes the instance from the index.
+func (idx *selectorIndex) remove(inst *model.Instance) {
+	pairs, found := idx.pairs[inst]
+	if !found {
+		idx.unindexed = removeInstance(idx.unindexed, inst)
+		return
+	}
+	delete(idx.pairs, inst)
+	for _, p := range pairs {
+		insts := removeInstance(idx.postings[p], inst)
+		if len(insts) == 0 {
+			delete(idx.postings, p)
+			continue
+		}
+		idx.postings[p] = insts
+	}
+}
+
+// candidates returns the instances which may match the input labels, sorted by metadata
+// namespace and name.
+func (idx *selectorIndex) candidates(lbls interface{}) []*model.Instance {
+	var lists [][]*model.Instance
+	cnt := len(idx.unindexed)
+	if cnt != 0 {
+		lists = append(lists, idx.unindexed)
+	}
+	forEachLabel(lbls, func(label, value string) {
+		insts, found := idx.postings[labelPair{label: label, value: value}]
+		if found {
+			lists = append(lists, insts)
+			cnt += len(insts)
+		}
+	})
+	switch len(lists) {
+	case 0:
+		return nil
+	case 1:
+		return lists[0]
+	}
+	cands := make([]*model.Instance, 0, cnt)
+	for _, insts := range lists {
+		cands = append(cands, insts...)
+	}
+	sort.SliceStable(cands, func(i, j int) bool {
+		return instanceLess(cands[i], cands[j])
+	})
+	return cands
+}
+
+// indexPairs returns the label pairs under which the instance should be indexed.
+func (idx *selectorIndex) indexPairs(inst *model.Instance) []labelPair {
+	var best *labelPair
+	bestCnt := 0
+	for _, sel := range inst.Selectors {
+		s, ok := sel.(*model.LabelSelector)
+		if !ok {
+			continue
+		}
+		for _, lbl := range sortedLabels(s.LabelValues) {
+			p := labelPair{label: lbl, value: s.LabelValues[lbl]}
+			insts := idx.postings[p]
+			if best == nil || len(insts) < bestCnt {
+				best = &p
+				bestCnt = len(insts)
+			}
+		}
+	}
+	if best != nil {
+		return []labelPair{*best}
+	}
+	for _, sel := range inst.Selectors {
+		s, ok := sel.(*model.ExpressionSelector)
+		if !ok || s.Operator != "In" {
+			continue
+		}
+		pairs := make([]labelPair, 0, len(s.Values))
+		seen := make(map[labelPair]struct{}, len(s.Values))
+		for _, v := range s.Values {
+			p := labelPair{label: s.Label, value: labelString(v)}
+			if _, found := seen[p]; found {
+				continue
+			}
+			seen[p] = struct{}{}
+			pairs = append(pairs, p)
+		}
+		return pairs
+	}
+	return nil
+}
+
+// forEachLabel invokes the function for each label key-value pair within supported map types.
+func forEachLabel(lbls interface{}, fn func(label, value string)) {
+	switch m := lbls.(type) {
+	case map[string]string:
+		for k, v := range m {
+			fn(k, v)
+		}
+	case map[string]interface{}:
+		for k, v := range m {
+			fn(k, labelString(v))
+		}
+	case traits.Mapper:
+		it := m.Iterator()
+		for it.HasNext() == types.True {
+			k := it.Next()
+			if key, ok := k.(types.String); ok {
+				fn(string(key), labelString(m.Get(k)))
+			}
+		}
+	}
+}
+
+func sortedLabels(lbls map[string]string) []string {
+	keys := make([]string, 0, len(lbls))
+	for k := range lbls {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// removeInstance removes the instance from the list by identity.
+func removeInstance(insts []*model.Instance, inst *model.Instance) []*model.Instance {
+	for i, cand := range insts {
+		if cand == inst {
+			return append(insts[:i:i], insts[i+1:]...)
+		}
+	}
+	return insts
+}
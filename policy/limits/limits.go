@@ -27,6 +27,7 @@ func NewLimits() *Limits {
 		ValidatorProductionLimit: 20,
 		RuleLimit:                10,
 		EvaluatorExprCostLimit:   -1,
+		EvaluationCostLimit:      -1,
 	}
 }
 
@@ -80,4 +81,12 @@ type Limits struct {
 
 	// Defaults to -1.
 	EvaluatorExprCostLimit int
+
+	// EvaluationCostLimit limits the actual cost of a single evaluation across all of the
+	// templates and instances evaluated. Each range iteration and each evaluation of a term,
+	// production match, decision reference, or decision output costs one unit. Evaluation is
+	// aborted once the cost exceeds the limit. A negative limit value is equivalent to unlimited.
+	//
+	// Defaults to -1.
+	EvaluationCostLimit int
 }
@@ -19,6 +19,7 @@ import (
 	"strings"
 
 	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common"
 	"github.com/google/cel-go/common/types"
 	"github.com/google/cel-go/common/types/ref"
 )
@@ -62,6 +63,10 @@ type SingleDecisionValue interface {
 
 	// RuleID indicate which policy rule id within an instance that produced the decision.
 	RuleID() int64
+
+	// Source returns the template, instance, rule, and production which produced the value, if
+	// known.
+	Source() *DecisionSource
 }
 
 // MultiDecisionValue extends the DecisionValue which contains a set of decision values as well as
@@ -79,6 +84,73 @@ type MultiDecisionValue interface {
 	// RulesIDs returns the rule id within an instance which produce the decision values.
 	// The value index corresponds to the rule id index.
 	RuleIDs() []int64
+
+	// Sources returns the template, instance, rule, and production which produced each value.
+	// The value index corresponds to the source index. The sources may be nil.
+	Sources() []*DecisionSource
+}
+
+// DecisionSource describes where a decision value came from: the template and instance under
+// evaluation, the instance rule, and the template production which emitted the value.
+type DecisionSource struct {
+	// Template is the metadata name of the template which produced the value.
+	Template string
+
+	// InstanceNamespace is the metadata namespace of the instance which produced the value.
+	InstanceNamespace string
+
+	// InstanceName is the metadata name of the instance which produced the value.
+	InstanceName string
+
+	// InstanceSource describes the instance source, such as its file name, if known.
+	InstanceSource string
+
+	// Rule is the instance rule under evaluation when the value was produced. The rule is nil
+	// for singleton templates which do not declare a rule schema.
+	Rule Rule
+
+	// RuleLocation is the location of the rule within the instance source, if known.
+	RuleLocation common.Location
+
+	// ProductionID is the id of the template production which emitted the value.
+	ProductionID int64
+
+	// ProductionLocation is the location of the production within the template source, if known.
+	ProductionLocation common.Location
+}
+
+// RuleID returns the id of the rule which produced the value, or zero if the rule is not set.
+func (src *DecisionSource) RuleID() int64 {
+	if src == nil || src.Rule == nil {
+		return 0
+	}
+	return src.Rule.GetID()
+}
+
+// String renders the decision source to a string for debug purposes.
+func (src *DecisionSource) String() string {
+	if src == nil {
+		return "<unknown>"
+	}
+	var buf strings.Builder
+	buf.WriteString(src.Template)
+	buf.WriteString("/")
+	if src.InstanceNamespace != "" {
+		buf.WriteString(src.InstanceNamespace)
+		buf.WriteString("/")
+	}
+	buf.WriteString(src.InstanceName)
+	buf.WriteString(fmt.Sprintf(" rule[%d]", src.RuleID()))
+	if src.RuleLocation != nil && src.RuleLocation != common.NoLocation {
+		buf.WriteString(fmt.Sprintf(" at %s:%d:%d",
+			src.InstanceSource, src.RuleLocation.Line(), src.RuleLocation.Column()))
+	}
+	buf.WriteString(fmt.Sprintf(" production[%d]", src.ProductionID))
+	if src.ProductionLocation != nil && src.ProductionLocation != common.NoLocation {
+		buf.WriteString(fmt.Sprintf(" at %d:%d",
+			src.ProductionLocation.Line(), src.ProductionLocation.Column()))
+	}
+	return buf.String()
 }
 
 // DecisionSelector determines whether the given decision is the decision set requested by the
@@ -99,7 +171,7 @@ type BoolDecisionValue struct {
 	value   ref.Val
 	isFinal bool
 	details *cel.EvalDetails
-	ruleID  int64
+	source  *DecisionSource
 }
 
 // And logically ANDs the current decision value with the incoming CEL value.
@@ -135,12 +207,22 @@ func (dv *BoolDecisionValue) Details() *cel.EvalDetails {
 func (dv *BoolDecisionValue) Finalize(details *cel.EvalDetails, rule Rule) DecisionValue {
 	dv.details = details
 	if rule != nil {
-		dv.ruleID = rule.GetID()
+		dv.source = &DecisionSource{Rule: rule}
 	}
 	dv.isFinal = true
 	return dv
 }
 
+// FinalizeWithSource marks the decision as immutable with additional input and indicates the
+// source and evaluation details which triggered the finalization.
+func (dv *BoolDecisionValue) FinalizeWithSource(details *cel.EvalDetails,
+	src *DecisionSource) DecisionValue {
+	dv.details = details
+	dv.source = src
+	dv.isFinal = true
+	return dv
+}
+
 // IsFinal returns whether the decision is final.
 func (dv *BoolDecisionValue) IsFinal() bool {
 	return dv.isFinal
@@ -176,7 +258,12 @@ func (dv *BoolDecisionValue) Name() string {
 
 // RuleID implements the SingleDecisionValue interface method.
 func (dv *BoolDecisionValue) RuleID() int64 {
-	return dv.ruleID
+	return dv.source.RuleID()
+}
+
+// Source implements the SingleDecisionValue interface method.
+func (dv *BoolDecisionValue) Source() *DecisionSource {
+	return dv.source
 }
 
 // String renders the decision value to a string for debug purposes.
@@ -184,7 +271,7 @@ func (dv *BoolDecisionValue) String() string {
 	var buf strings.Builder
 	buf.WriteString(dv.name)
 	buf.WriteString(": ")
-	buf.WriteString(fmt.Sprintf("rule[%d] -> ", dv.ruleID))
+	buf.WriteString(fmt.Sprintf("rule[%d] -> ", dv.RuleID()))
 	buf.WriteString(fmt.Sprintf("%v", dv.value))
 	return buf.String()
 }
@@ -202,6 +289,7 @@ func NewListDecisionValue(name string) *ListDecisionValue {
 		values:  []ref.Val{},
 		details: []*cel.EvalDetails{},
 		ruleIDs: []int64{},
+		sources: []*DecisionSource{},
 	}
 }
 
@@ -212,18 +300,35 @@ type ListDecisionValue struct {
 	isFinal bool
 	details []*cel.EvalDetails
 	ruleIDs []int64
+	sources []*DecisionSource
 }
 
 // Append accumulates the incoming CEL value into the decision's value list.
 func (dv *ListDecisionValue) Append(val ref.Val, det *cel.EvalDetails, rule Rule) {
-	dv.values = append(dv.values, val)
-	dv.details = append(dv.details, det)
-	// Rule ids may be null if the policy is a singleton.
-	ruleID := int64(0)
+	var src *DecisionSource
 	if rule != nil {
-		ruleID = rule.GetID()
+		src = &DecisionSource{Rule: rule}
 	}
-	dv.ruleIDs = append(dv.ruleIDs, ruleID)
+	dv.AppendWithSource(val, det, src)
+}
+
+// AppendWithSource accumulates the incoming CEL value into the decision's value list along with
+// the source which produced it.
+func (dv *ListDecisionValue) AppendWithSource(val ref.Val, det *cel.EvalDetails,
+	src *DecisionSource) {
+	dv.values = append(dv.values, val)
+	dv.details = append(dv.details, det)
+	// Rule ids may be zero if the policy is a singleton.
+	dv.ruleIDs = append(dv.ruleIDs, src.RuleID())
+	dv.sources = append(dv.sources, src)
+}
+
+// Concat appends the values of another list decision, along with their details and sources.
+func (dv *ListDecisionValue) Concat(other *ListDecisionValue) {
+	dv.values = append(dv.values, other.values...)
+	dv.details = append(dv.details, other.details...)
+	dv.ruleIDs = append(dv.ruleIDs, other.ruleIDs...)
+	dv.sources = append(dv.sources, other.sources...)
 }
 
 // Details returns the list of evaluation details observed in computing the values in the decision.
@@ -254,6 +359,12 @@ func (dv *ListDecisionValue) RuleIDs() []int64 {
 	return dv.ruleIDs
 }
 
+// Sources returns the list of decision sources which produced the evaluation results.
+// The indices of the sources correlate 1:1 with the value indices.
+func (dv *ListDecisionValue) Sources() []*DecisionSource {
+	return dv.sources
+}
+
 func (dv *ListDecisionValue) String() string {
 	var buf strings.Builder
 	buf.WriteString(dv.name)
@@ -276,6 +387,79 @@ func (dv *ListDecisionValue) Values() []ref.Val {
 	return dv.values
 }
 
+// NewValueDecisionValue returns a named decision with a single value along with the evaluation
+// details and source which produced the value.
+func NewValueDecisionValue(name string,
+	value ref.Val,
+	details *cel.EvalDetails,
+	src *DecisionSource) *ValueDecisionValue {
+	return &ValueDecisionValue{
+		name:    name,
+		value:   value,
+		details: details,
+		source:  src,
+	}
+}
+
+// ValueDecisionValue represents a decision with a single value of any type, such as the value
+// selected by a combining algorithm or a numeric aggregate.
+//
+// The value is nil until a value has been produced for the decision.
+type ValueDecisionValue struct {
+	name    string
+	value   ref.Val
+	isFinal bool
+	details *cel.EvalDetails
+	source  *DecisionSource
+}
+
+// Details implements the SingleDecisionValue interface method.
+func (dv *ValueDecisionValue) Details() *cel.EvalDetails {
+	return dv.details
+}
+
+// Finalize marks the decision as immutable.
+func (dv *ValueDecisionValue) Finalize() DecisionValue {
+	dv.isFinal = true
+	return dv
+}
+
+// IsFinal implements the DecisionValue interface method.
+func (dv *ValueDecisionValue) IsFinal() bool {
+	return dv.isFinal
+}
+
+// Name implements the DecisionValue interface method.
+func (dv *ValueDecisionValue) Name() string {
+	return dv.name
+}
+
+// RuleID implements the SingleDecisionValue interface method.
+func (dv *ValueDecisionValue) RuleID() int64 {
+	return dv.source.RuleID()
+}
+
+// Source implements the SingleDecisionValue interface method.
+//
+// The source may be nil when the value combines the values of several sources, as with sums.
+func (dv *ValueDecisionValue) Source() *DecisionSource {
+	return dv.source
+}
+
+func (dv *ValueDecisionValue) String() string {
+	var buf strings.Builder
+	buf.WriteString(dv.name)
+	buf.WriteString(": ")
+	buf.WriteString(fmt.Sprintf("rule[%d] -> ", dv.RuleID()))
+	buf.WriteString(fmt.Sprintf("%v", dv.value))
+	return buf.String()
+}
+
+// Value implements the SingleDecisionValue interface method.
+func (dv *ValueDecisionValue) Value() ref.Val {
+	return dv.value
+}
+
 func logicallyMergeUnkErr(value, other ref.Val) ref.Val {
 	vUnk := types.IsUnknown(value)
 	oUnk := types.IsUnknown(other)
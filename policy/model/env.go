@@ -74,6 +74,16 @@ func (e *Env) ExprEnvOptions() []cel.EnvOption {
 	return opts
 }
 
+// FindVar returns the variable declared with the given name, if present.
+func (e *Env) FindVar(name string) (*Var, bool) {
+	for _, v := range e.Vars {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
 // NewVar creates a new variable with a name and a type.
 func NewVar(name string, dt *DeclType) *Var {
 	return &Var{
@@ -17,15 +17,17 @@ package model
 
 import (
 	"strings"
+	"time"
 )
 
 // NewInstance returns an empty policy instance.
 func NewInstance(info SourceMetadata) *Instance {
 	return &Instance{
-		Metadata:  &InstanceMetadata{},
-		Selectors: []Selector{},
-		Rules:     []Rule{},
-		Meta:      info,
+		Metadata:          &InstanceMetadata{},
+		EnforcementAction: EnforcementDeny,
+		Selectors:         []Selector{},
+		Rules:             []Rule{},
+		Meta:              info,
 	}
 }
 
@@ -36,6 +38,10 @@ type Instance struct {
 	Metadata    *InstanceMetadata
 	Description string
 
+	// EnforcementAction determines how the decisions produced by the instance are used, either
+	// EnforcementDeny, EnforcementWarn, or EnforcementDryRun.
+	EnforcementAction string
+
 	// Selectors determine whether the instance applies to the current evaluation context.
 	// All Selector values must return true for the policy instance to be included in policy
 	// evaluation step.
@@ -50,6 +56,26 @@ type Instance struct {
 	Meta SourceMetadata
 }
 
+// IsAdvisory returns whether the decisions produced by the instance are advisory rather than
+// enforced.
+func (i *Instance) IsAdvisory() bool {
+	return i.EnforcementAction == EnforcementWarn || i.EnforcementAction == EnforcementDryRun
+}
+
+const (
+	// EnforcementDeny indicates the decisions produced by an instance are enforced. This is the
+	// default enforcement action.
+	EnforcementDeny = "deny"
+
+	// EnforcementWarn indicates the decisions produced by an instance are reported as warnings
+	// rather than enforced.
+	EnforcementWarn = "warn"
+
+	// EnforcementDryRun indicates the decisions produced by an instance are recorded for review,
+	// but neither enforced nor reported as warnings.
+	EnforcementDryRun = "dryrun"
+)
+
 // MetadataMap returns the metadata name to value map, which can be used in evaluation.
 // Only "name" field is supported for now.
 func (i *Instance) MetadataMap() map[string]interface{} {
@@ -58,11 +84,31 @@ func (i *Instance) MetadataMap() map[string]interface{} {
 	}
 }
 
+// IsActive returns whether the instance is in effect at the given time according to the
+// NotBefore and NotAfter times of its metadata.
+func (i *Instance) IsActive(now time.Time) bool {
+	if i.Metadata == nil {
+		return true
+	}
+	meta := i.Metadata
+	if !meta.NotBefore.IsZero() && now.Before(meta.NotBefore) {
+		return false
+	}
+	return meta.NotAfter.IsZero() || !now.After(meta.NotAfter)
+}
+
 // InstanceMetadata contains standard metadata which may be associated with an instance.
 type InstanceMetadata struct {
 	UID       string
 	Name      string
 	Namespace string
+
+	// NotBefore is the time at which the instance takes effect, if set. Both NotBefore and
+	// NotAfter are inclusive.
+	NotBefore time.Time
+
+	// NotAfter is the time after which the instance no longer takes effect, if set.
+	NotAfter time.Time
 }
 
 // Selector interface indicates a pre-formatted instance selection condition.
@@ -90,7 +136,8 @@ type ExpressionSelector struct {
 	// Label name being matched.
 	Label string
 
-	// Operator determines the evaluation behavior. Must be one of Exists, NotExists, In, or NotIn.
+	// Operator determines the evaluation behavior. Must be one of Exists, DoesNotExist, In, or
+	// NotIn.
 	Operator string
 
 	// Values set, optional, to be used in the NotIn, In set membership tests.
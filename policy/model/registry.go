@@ -180,6 +180,16 @@ func (r *Registry) SetTemplate(name string, tmpl *Template) error {
 	return nil
 }
 
+// RemoveTemplate unregisters a template by its fully qualified name, returning whether the
+// template was present.
+func (r *Registry) RemoveTemplate(name string) bool {
+	r.rwMux.Lock()
+	defer r.rwMux.Unlock()
+	_, found := r.templates[name]
+	delete(r.templates, name)
+	return found
+}
+
 // SetType registers a DeclType descriptor by its fully qualified name.
 func (r *Registry) SetType(name string, declType *DeclType) error {
 	r.rwMux.Lock()
@@ -250,6 +250,34 @@ properties:
     type: string
   schema:
     $ref: "#openAPISchema"
+  decisions:
+    type: object
+    additionalProperties:
+      type: object
+      properties:
+        aggregate:
+          type: string
+          enum:
+            - and
+            - or
+            - collect
+            - collectFirst
+            - firstApplicable
+            - denyOverrides
+            - permitOverrides
+            - priority
+            - min
+            - max
+            - sum
+            - count
+        finalize:
+          type: string
+          enum:
+            - policySet
+            - instance
+            - rule
+        schema:
+          $ref: "#openAPISchema"
   validator:
     type: object
     required:
@@ -345,10 +373,20 @@ properties:
     type: string
   metadata:
     type: object
+    properties:
+      notBefore:
+        type: string
+        format: date-time
+      notAfter:
+        type: string
+        format: date-time
     additionalProperties:
       type: string
   description:
     type: string
+  enforcementAction:
+    type: string
+    enum: ["deny", "warn", "dryrun"]
   selector:
     type: object
     properties:
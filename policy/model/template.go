@@ -36,6 +36,7 @@ type Template struct {
 	Metadata    *TemplateMetadata
 	Description string
 	RuleTypes   *RuleTypes
+	Decisions   []*DecisionDecl
 	Validator   *Evaluator
 	Evaluator   *Evaluator
 	Meta        SourceMetadata
@@ -47,6 +48,16 @@ func (t *Template) EvaluatorDecisionCount() int {
 	return t.Evaluator.DecisionCount()
 }
 
+// FindDecisionDecl returns the declaration of the decision with the given name, if present.
+func (t *Template) FindDecisionDecl(name string) (*DecisionDecl, bool) {
+	for _, d := range t.Decisions {
+		if d.Name == name {
+			return d, true
+		}
+	}
+	return nil, false
+}
+
 // MetadataMap returns the metadata name to value map, which can be used in evaluation.
 // Only "name" field is supported for now.
 func (t *Template) MetadataMap() map[string]interface{} {
@@ -78,6 +89,51 @@ type TemplateMetadata struct {
 	Properties map[string]string
 }
 
+// Aggregation strategies which may be declared for a template decision.
+const (
+	AggregateAnd             = "and"
+	AggregateOr              = "or"
+	AggregateCollect         = "collect"
+	AggregateCollectFirst    = "collectFirst"
+	AggregateFirstApplicable = "firstApplicable"
+	AggregateDenyOverrides   = "denyOverrides"
+	AggregatePermitOverrides = "permitOverrides"
+	AggregatePriority        = "priority"
+	AggregateMin             = "min"
+	AggregateMax             = "max"
+	AggregateSum             = "sum"
+	AggregateCount           = "count"
+)
+
+// Finalization scopes which may be declared for a template decision.
+const (
+	FinalizePolicySet = "policySet"
+	FinalizeInstance  = "instance"
+	FinalizeRule      = "rule"
+)
+
+// NewDecisionDecl returns a DecisionDecl which collects values of any type for the given name.
+func NewDecisionDecl(id int64, name string) *DecisionDecl {
+	return &DecisionDecl{
+		ID:        id,
+		Name:      name,
+		Type:      AnyType,
+		Aggregate: AggregateCollect,
+		Finalize:  FinalizePolicySet,
+	}
+}
+
+// DecisionDecl declares the type of the outputs emitted for a named decision, the strategy used
+// to aggregate them into the decision value, and the scope within which a finalized decision
+// suppresses further contributions.
+type DecisionDecl struct {
+	ID        int64
+	Name      string
+	Type      *DeclType
+	Aggregate string
+	Finalize  string
+}
+
 // NewEvaluator returns an empty instance of a Template Evaluator.
 func NewEvaluator() *Evaluator {
 	return &Evaluator{
@@ -102,11 +158,96 @@ type Evaluator struct {
 	Productions []*Production
 }
 
+// TermVariables returns the names of the variables referenced by each term, keyed by term name.
+//
+// The variables referenced indirectly via other terms are included, while the names of the terms
+// themselves and of the variables bound within comprehensions are not. Qualified references such
+// as 'rule.greeting' are reported by the name of their leading identifier, 'rule'.
+func (e *Evaluator) TermVariables() map[string]map[string]struct{} {
+	termVars := make(map[string]map[string]struct{}, len(e.Terms))
+	for _, t := range e.Terms {
+		vars := map[string]struct{}{}
+		if t.Expr != nil {
+			collectFreeVars(t.Expr.Expr(), map[string]int{}, vars)
+		}
+		termVars[t.Name] = vars
+	}
+	// Expand the term references until the variable sets no longer change. Terms are expected to
+	// only depend on the terms which precede them, but the expansion does not rely on it.
+	for changed := true; changed; {
+		changed = false
+		for _, t := range e.Terms {
+			vars := termVars[t.Name]
+			for name := range vars {
+				refVars, isTerm := termVars[name]
+				if !isTerm {
+					continue
+				}
+				delete(vars, name)
+				for v := range refVars {
+					if _, found := vars[v]; !found && v != t.Name {
+						vars[v] = struct{}{}
+					}
+				}
+				changed = true
+			}
+		}
+	}
+	return termVars
+}
+
+// collectFreeVars records the identifiers referenced by the expression which are not bound by an
+// enclosing comprehension.
+func collectFreeVars(e *exprpb.Expr, bound map[string]int, vars map[string]struct{}) {
+	if e == nil {
+		return
+	}
+	switch k := e.ExprKind.(type) {
+	case *exprpb.Expr_IdentExpr:
+		name := k.IdentExpr.GetName()
+		if bound[name] == 0 {
+			vars[name] = struct{}{}
+		}
+	case *exprpb.Expr_SelectExpr:
+		collectFreeVars(k.SelectExpr.GetOperand(), bound, vars)
+	case *exprpb.Expr_CallExpr:
+		collectFreeVars(k.CallExpr.GetTarget(), bound, vars)
+		for _, arg := range k.CallExpr.GetArgs() {
+			collectFreeVars(arg, bound, vars)
+		}
+	case *exprpb.Expr_ListExpr:
+		for _, elem := range k.ListExpr.GetElements() {
+			collectFreeVars(elem, bound, vars)
+		}
+	case *exprpb.Expr_StructExpr:
+		for _, entry := range k.StructExpr.GetEntries() {
+			collectFreeVars(entry.GetMapKey(), bound, vars)
+			collectFreeVars(entry.GetValue(), bound, vars)
+		}
+	case *exprpb.Expr_ComprehensionExpr:
+		comp := k.ComprehensionExpr
+		collectFreeVars(comp.GetIterRange(), bound, vars)
+		collectFreeVars(comp.GetAccuInit(), bound, vars)
+		bound[comp.GetIterVar()]++
+		bound[comp.GetAccuVar()]++
+		collectFreeVars(comp.GetLoopCondition(), bound, vars)
+		collectFreeVars(comp.GetLoopStep(), bound, vars)
+		collectFreeVars(comp.GetResult(), bound, vars)
+		bound[comp.GetIterVar()]--
+		bound[comp.GetAccuVar()]--
+	}
+}
+
 // DecisionCount returns the number of possible decisions which could be emitted by this evaluator.
+//
+// Decisions whose names are computed from a reference expression are not included in the count.
 func (e *Evaluator) DecisionCount() int {
 	decMap := map[string]struct{}{}
 	for _, p := range e.Productions {
 		for _, d := range p.Decisions {
+			if d.Reference != nil {
+				continue
+			}
 			decMap[d.Name] = struct{}{}
 		}
 	}
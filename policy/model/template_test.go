@@ -0,0 +1,55 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/cel-go/cel"
+)
+
+func TestEvaluator_TermVariables(t *testing.T) {
+	stdEnv, _ := cel.NewEnv()
+	terms := []struct {
+		name string
+		expr string
+	}{
+		{name: "hi", expr: `rule.greeting`},
+		{name: "allowed", expr: `rule.destinations.filter(d, d.startsWith(hi))`},
+		{name: "dest", expr: `destination.ip in allowed`},
+		{name: "limit", expr: `[1, 2, 3].exists(x, x > 2)`},
+		{name: "labeled", expr: `resource.labels.exists(k, k == hi) && dest`},
+	}
+	eval := NewEvaluator()
+	for i, term := range terms {
+		ast, iss := stdEnv.Parse(term.expr)
+		if iss.Err() != nil {
+			t.Fatal(iss.Err())
+		}
+		eval.Terms = append(eval.Terms, NewTerm(int64(i), term.name, ast))
+	}
+	want := map[string]map[string]struct{}{
+		"hi":      {"rule": {}},
+		"allowed": {"rule": {}},
+		"dest":    {"destination": {}, "rule": {}},
+		"limit":   {},
+		"labeled": {"destination": {}, "resource": {}, "rule": {}},
+	}
+	got := eval.TermVariables()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got term variables %v, wanted %v", got, want)
+	}
+}
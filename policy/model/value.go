@@ -17,6 +17,7 @@ package model
 import (
 	"fmt"
 	"reflect"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/cel-go/common/types"
@@ -69,7 +70,15 @@ type DynValue struct {
 	ID          int64
 	Value       interface{}
 	EncodeStyle EncodeStyle
-	exprValue   ref.Val
+	// exprValue holds the exprValueRef computed for the value. Instances are evaluated
+	// concurrently, so the lazily computed value is stored atomically.
+	exprValue atomic.Value
+}
+
+// exprValueRef wraps the CEL value of a DynValue so the atomic.Value always stores the same
+// concrete type.
+type exprValueRef struct {
+	val ref.Val
 }
 
 // DeclType returns the policy model type of the dyn value.
@@ -149,11 +158,13 @@ func (dv *DynValue) Equal(other ref.Val) ref.Val {
 
 // ExprValue converts the DynValue into a CEL value.
 func (dv *DynValue) ExprValue() ref.Val {
-	if dv.exprValue == nil {
-		// TODO: implement eager initialization.
-		dv.exprValue = exprValue(dv)
+	if cached, ok := dv.exprValue.Load().(exprValueRef); ok {
+		return cached.val
 	}
-	return dv.exprValue
+	// TODO: implement eager initialization.
+	val := exprValue(dv)
+	dv.exprValue.Store(exprValueRef{val: val})
+	return val
 }
 
 // Type returns the CEL type for the given value.
@@ -15,6 +15,9 @@
 package policy
 
 import (
+	"reflect"
+	"time"
+
 	"github.com/google/cel-policy-templates-go/policy/model"
 	"github.com/google/cel-policy-templates-go/policy/runtime"
 
@@ -25,6 +28,9 @@ import (
 // EngineOption is a functional option for configuring the policy engine.
 type EngineOption func(*Engine) (*Engine, error)
 
+// EvalOption is a functional option for configuring a single evaluation.
+type EvalOption func(*runtime.Evaluation) (*runtime.Evaluation, error)
+
 // Selector functions take a compiled representation of a policy instance 'selector' and the input
 // argument set to determine whether the policy instance is applicable to the current evaluation
 // context.
@@ -32,6 +38,10 @@ type Selector func(model.Selector, interpreter.Activation) bool
 
 // Selectors is a functional option which may be configured to select a subset of policy instances
 // which are applicable to the current evaluation context.
+//
+// An instance is selected when each of its selectors is matched by at least one of the Selector
+// functions. LabelSelector and ExpressionSelector provide standard implementations for the
+// 'matchLabels' and 'matchExpressions' instance selectors.
 func Selectors(selectors ...Selector) EngineOption {
 	return func(e *Engine) (*Engine, error) {
 		e.selectors = selectors
@@ -39,6 +49,108 @@ func Selectors(selectors ...Selector) EngineOption {
 	}
 }
 
+// SupportedSelectors declares the types of the instance selectors which the configured Selector
+// functions support, e.g. &model.LabelSelector{} and &model.ExpressionSelector{} for the
+// LabelSelector and ExpressionSelector functions.
+//
+// Instances with a selector of any other type are rejected when added to the engine, rather than
+// never being selected. By default, instance selectors are not checked.
+func SupportedSelectors(selectors ...model.Selector) EngineOption {
+	return func(e *Engine) (*Engine, error) {
+		e.selTypes = map[reflect.Type]struct{}{}
+		for _, sel := range selectors {
+			e.selTypes[reflect.TypeOf(sel)] = struct{}{}
+		}
+		return e, nil
+	}
+}
+
+// SelectorIndex enables an inverted index over the 'matchLabels' and 'In' expression selectors
+// of the configured instances so that evaluation only visits the instances whose selectors may
+// match the labels found at the given input variable path, e.g. 'resource.labels'.
+//
+// The index assumes the selectors are evaluated with the semantics of the LabelSelector and
+// ExpressionSelector functions configured with the same labels path. Candidate instances are
+// still checked against all of the configured Selectors.
+func SelectorIndex(labelsPath string) EngineOption {
+	return func(e *Engine) (*Engine, error) {
+		e.lblsPath = labelsPath
+		if e.indexes == nil {
+			e.indexes = map[string]*selectorIndex{}
+		}
+		return e, nil
+	}
+}
+
+// Parallelism configures the maximum number of instances which may be evaluated concurrently
+// within a single evaluation call.
+//
+// Decisions are merged in the same order as sequential evaluation, so the decisions produced do
+// not depend on the degree of parallelism. Values less than or equal to one result in sequential
+// evaluation, which is the default.
+//
+// Concurrently evaluated decisions are combined with runtime.Merger, so parallel evaluation
+// returns an error for decisions whose aggregator does not implement it.
+func Parallelism(workers int) EngineOption {
+	return func(e *Engine) (*Engine, error) {
+		e.workers = workers
+		return e, nil
+	}
+}
+
+// BatchParallelism configures the maximum number of inputs which may be evaluated concurrently
+// by EvalBatch.
+//
+// Results are reported in input order regardless of the degree of parallelism. Values less than
+// or equal to one result in sequential evaluation, which is the default. The Parallelism option
+// continues to apply to the instances evaluated for each input.
+func BatchParallelism(workers int) EngineOption {
+	return func(e *Engine) (*Engine, error) {
+		e.batchWkrs = workers
+		return e, nil
+	}
+}
+
+// Clock configures the function which supplies the time of each evaluation.
+//
+// The evaluation time determines which instances are in effect according to their 'notBefore'
+// and 'notAfter' metadata, and is exposed to template expressions as the 'now' variable. The
+// variable name is reserved: environments which declare their own 'now' variable fail to compile
+// and must rename it. The default is time.Now.
+func Clock(clock func() time.Time) EngineOption {
+	return func(e *Engine) (*Engine, error) {
+		e.clock = clock
+		return e, nil
+	}
+}
+
+// ContinueOnError configures the engine to continue evaluating the remaining instances when the
+// evaluation of an instance fails.
+//
+// The decisions produced by the other instances, as well as those produced by the failing
+// instances before the failure, are returned along with a runtime.EvalErrors value which lists
+// every failing term, match, and output. By default, evaluation stops at the first instance
+// which fails and no decisions are returned.
+func ContinueOnError() EngineOption {
+	return func(e *Engine) (*Engine, error) {
+		e.contOnErr = true
+		return e, nil
+	}
+}
+
+// PartialEval enables partial evaluation via Engine.EvalPartial, where some input attributes may
+// be declared unknown.
+//
+// Partial evaluation tracks the evaluation state of each expression in order to compute residual
+// expressions, which makes all evaluations performed by the engine somewhat slower.
+func PartialEval() EngineOption {
+	return func(e *Engine) (*Engine, error) {
+		e.partial = true
+		e.rtOpts = append(e.rtOpts, runtime.PartialEval())
+		return e, nil
+	}
+}
+
 // StandardExprEnv configures the CEL expression environment to be used as the basis for all
 // other environment derivations within templates.
 func StandardExprEnv(exprEnv *cel.Env) EngineOption {
@@ -119,6 +231,45 @@ func EvaluatorExprCostLimit(limit int) EngineOption {
 	}
 }
 
+// EvaluationCostLimit sets the limit on the actual cost of a single evaluation. Evaluation is
+// aborted with a *runtime.CostLimitError once the limit is exceeded.
+//
+// The limit may be overridden for an individual evaluation using the CostLimit option.
+func EvaluationCostLimit(limit int) EngineOption {
+	return func(e *Engine) (*Engine, error) {
+		e.limits.EvaluationCostLimit = limit
+		return e, nil
+	}
+}
+
+// CostLimit overrides the engine's EvaluationCostLimit for a single evaluation. A negative limit
+// is equivalent to unlimited.
+func CostLimit(limit int) EvalOption {
+	return func(ev *runtime.Evaluation) (*runtime.Evaluation, error) {
+		ev.SetCostLimit(limit)
+		return ev, nil
+	}
+}
+
+// ContinueOnInstanceError configures a single evaluation to continue evaluating the remaining
+// instances when the evaluation of an instance fails, as with the ContinueOnError engine option.
+func ContinueOnInstanceError() EvalOption {
+	return func(ev *runtime.Evaluation) (*runtime.Evaluation, error) {
+		ev.SetContinueOnError(true)
+		return ev, nil
+	}
+}
+
+// IncludeAdvisories configures EvalBatch to also evaluate the instances whose enforcement action
+// is 'warn' or 'dryrun', and to report their decisions via BatchResult.Advisories. By default,
+// batch inputs are evaluated as though by EvalContext, and the advisory instances are skipped.
+func IncludeAdvisories() EvalOption {
+	return func(ev *runtime.Evaluation) (*runtime.Evaluation, error) {
+		ev.SetIncludeAdvisories(true)
+		return ev, nil
+	}
+}
+
 // RuntimeTemplateOptions collects a set of runtime specific options to be configured on runtime
 // templates.
 func RuntimeTemplateOptions(rtOpts ...runtime.TemplateOption) EngineOption {
@@ -127,3 +278,14 @@ func RuntimeTemplateOptions(rtOpts ...runtime.TemplateOption) EngineOption {
 		return e, nil
 	}
 }
+
+// TemplateRuntimeOptions collects a set of runtime specific options to be configured only on the
+// runtime template with the given metadata name, such as error dispositions for its decisions.
+//
+// The options are applied after those configured via RuntimeTemplateOptions.
+func TemplateRuntimeOptions(template string, rtOpts ...runtime.TemplateOption) EngineOption {
+	return func(e *Engine) (*Engine, error) {
+		e.tmplOpts[template] = append(e.tmplOpts[template], rtOpts...)
+		return e, nil
+	}
+}
@@ -15,10 +15,13 @@
 package runtime
 
 import (
+	"fmt"
+
 	"github.com/google/cel-policy-templates-go/policy/model"
 
 	"github.com/google/cel-go/cel"
 	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
 	"github.com/google/cel-go/interpreter"
 )
 
@@ -30,13 +33,44 @@ import (
 // is capable of indicating when to exit the comprehension by whether or not its marked final.
 type Aggregator interface {
 	DefaultDecision() model.DecisionValue
-
 	Aggregate(cel.Program,
 		interpreter.Activation,
 		model.DecisionValue,
 		model.Rule) (model.DecisionValue, error)
 }
 
+// SourceAggregator is an optional Aggregator extension which records the full DecisionSource of
+// the values it aggregates rather than only the rule.
+//
+// When an aggregator implements SourceAggregator, the runtime calls AggregateSource in place of
+// Aggregate. All of the aggregators provided by this package implement the interface.
+type SourceAggregator interface {
+	// AggregateSource combines the previous decision value with the value produced by the program.
+	//
+	// The DecisionSource describes the template, instance, rule, and production responsible for
+	// the program evaluation and should be recorded alongside the values it contributes.
+	AggregateSource(cel.Program,
+		interpreter.Activation,
+		model.DecisionValue,
+		*model.DecisionSource) (model.DecisionValue, error)
+}
+
+// Merger is an optional Aggregator extension which merges decisions aggregated independently of
+// one another.
+//
+// Aggregators must implement Merger in order to be used with parallel instance evaluation or with
+// a DecisionFinalization scope narrower than the policy set. All of the aggregators provided by
+// this package implement the interface.
+type Merger interface {
+	// Merge combines the previous decision value with the next decision value, where the next
+	// value was aggregated independently from the default decision.
+	//
+	// The result must be the same as if the values which produced the next decision had been
+	// aggregated directly onto the previous decision, so that decisions aggregated in parallel
+	// can be merged in evaluation order.
+	Merge(prev, next model.DecisionValue) (model.DecisionValue, error)
+}
+
 // NewAndAggregator returns a RuntimeOption which configures an ANDing aggregator for a given
 // decision name.
 func NewAndAggregator(name string) TemplateOption {
@@ -61,21 +95,39 @@ func (and *AndAggregator) DefaultDecision() model.DecisionValue {
 	return model.NewBoolDecisionValue(and.name, types.True)
 }
 
-// Aggregate combines the previous decision with the current value from CEl evaluation.
-//
-// If the value is False, the decision is finalized as no additional information can change the
-// aggregation result.
+// Aggregate implements the Aggregator interface method, recording the rule as the value source.
 func (and *AndAggregator) Aggregate(prg cel.Program, vars interpreter.Activation,
 	prev model.DecisionValue, rule model.Rule) (model.DecisionValue, error) {
-	val, det, _ := prg.Eval(vars)
-	prevBool := prev.(*model.BoolDecisionValue)
+	return and.AggregateSource(prg, vars, prev, ruleSource(rule))
+}
+
+// AggregateSource combines the previous decision with the current value from CEl evaluation.
+//
+// If the value is False, the decision is finalized as no additional information can change the
+// aggregation result. Evaluation errors are returned rather than combined into the decision so
+// that the error disposition configured for the decision determines the outcome.
+func (and *AndAggregator) AggregateSource(prg cel.Program, vars interpreter.Activation,
+	prev model.DecisionValue, src *model.DecisionSource) (model.DecisionValue, error) {
+	val, det, err := prg.Eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	prevBool, ok := prev.(*model.BoolDecisionValue)
+	if !ok {
+		return nil, decisionTypeError(and.name, prev, "*model.BoolDecisionValue")
+	}
 	decVal := prevBool.And(val)
 	if decVal.Value() == types.False {
-		decVal.Finalize(det, rule)
+		decVal.FinalizeWithSource(det, src)
 	}
 	return decVal, nil
 }
 
+// Merge ANDs the next decision into the previous one unless the previous decision is final.
+func (and *AndAggregator) Merge(prev, next model.DecisionValue) (model.DecisionValue, error) {
+	return mergeBool(prev, next, (*model.BoolDecisionValue).And)
+}
+
 // NewCollectAggregator creates a new CollectAggregator which accumulates values emitted for
 // the given decision name.
 func NewCollectAggregator(name string) TemplateOption {
@@ -88,11 +140,28 @@ func NewCollectAggregator(name string) TemplateOption {
 	)
 }
 
+// NewCollectFirstAggregator creates a new CollectAggregator which finalizes the decision once the
+// first value has been collected.
+//
+// Combined with a rule or instance DecisionFinalization scope, the aggregator collects the first
+// value emitted for the decision by each rule or instance respectively.
+func NewCollectFirstAggregator(name string) TemplateOption {
+	return DecisionAggregator(
+		name,
+		&CollectAggregator{
+			name:   name,
+			defDec: model.NewListDecisionValue(name),
+			first:  true,
+		},
+	)
+}
+
 // CollectAggregator accumulates each value emitted for the given decision name into a list of
 // values associated with the decision.
 type CollectAggregator struct {
 	name   string
 	defDec *model.ListDecisionValue
+	first  bool
 }
 
 // DefaultDecision produces a decision whose default decision value is empty set.
@@ -100,25 +169,63 @@ func (col *CollectAggregator) DefaultDecision() model.DecisionValue {
 	return col.defDec
 }
 
-// Aggregate appends the value produced by evaluating the CEL program (if not error) with the
+// Aggregate implements the Aggregator interface method, recording the rule as the value source.
+func (col *CollectAggregator) Aggregate(prg cel.Program, vars interpreter.Activation,
+	prev model.DecisionValue, rule model.Rule) (model.DecisionValue, error) {
+	return col.AggregateSource(prg, vars, prev, ruleSource(rule))
+}
+
+// AggregateSource appends the value produced by evaluating the CEL program (if not error) with the
 // previous values observed for the decision.
 //
 // Note: the collect aggregator does not quite follow CEL semantics with respect to list
 // construction as the output decision value may include CEL types.Unknown values within it.
 // It is up to the application to decide whether to error or resolve the unknowns.
-func (col *CollectAggregator) Aggregate(prg cel.Program, vars interpreter.Activation,
-	prev model.DecisionValue, rule model.Rule) (model.DecisionValue, error) {
+func (col *CollectAggregator) AggregateSource(prg cel.Program, vars interpreter.Activation,
+	prev model.DecisionValue, src *model.DecisionSource) (model.DecisionValue, error) {
 	val, det, err := prg.Eval(vars)
 	if err != nil {
 		return nil, err
 	}
-	var prevList *model.ListDecisionValue
-	if prev != col.defDec {
-		prevList = prev.(*model.ListDecisionValue)
-	} else {
-		prevList = model.NewListDecisionValue(col.name)
+	prevList, err := col.list(prev)
+	if err != nil {
+		return nil, err
+	}
+	prevList.AppendWithSource(val, det, src)
+	if col.first {
+		prevList.Finalize()
+	}
+	return prevList, nil
+}
+
+// Merge appends the values of the next decision to the values of the previous decision unless the
+// previous decision is final.
+func (col *CollectAggregator) Merge(prev, next model.DecisionValue) (model.DecisionValue, error) {
+	if prev.IsFinal() {
+		return prev, nil
+	}
+	prevList, err := col.list(prev)
+	if err != nil {
+		return nil, err
+	}
+	nextList, ok := next.(*model.ListDecisionValue)
+	if !ok {
+		return nil, decisionTypeError(col.name, next, "*model.ListDecisionValue")
+	}
+	prevList.Concat(nextList)
+	return prevList, nil
+}
+
+// list returns the list decision to append values to, creating a new list in place of the
+// shared default decision.
+func (col *CollectAggregator) list(prev model.DecisionValue) (*model.ListDecisionValue, error) {
+	if prev == col.defDec {
+		return model.NewListDecisionValue(col.name), nil
+	}
+	prevList, ok := prev.(*model.ListDecisionValue)
+	if !ok {
+		return nil, decisionTypeError(col.name, prev, "*model.ListDecisionValue")
 	}
-	prevList.Append(val, det, rule)
 	return prevList, nil
 }
 
@@ -141,30 +248,111 @@ type OrAggregator struct {
 }
 
 // DefaultDecision produces a decision whose default decision value is 'false'.
+//
+// A new decision value is produced on each call as the decision may be combined with the values
+// produced by other aggregators for the same decision name.
 func (or *OrAggregator) DefaultDecision() model.DecisionValue {
-	return or.defDec
+	return model.NewBoolDecisionValue(or.name, types.False)
+}
+
+// Aggregate implements the Aggregator interface method, recording the rule as the value source.
+func (or *OrAggregator) Aggregate(prg cel.Program, vars interpreter.Activation,
+	prev model.DecisionValue, rule model.Rule) (model.DecisionValue, error) {
+	return or.AggregateSource(prg, vars, prev, ruleSource(rule))
 }
 
-// Aggregate combines the value produced by the incoming CEL value with the previous value
+// AggregateSource combines the value produced by the incoming CEL value with the previous value
 // observed by the aggregator using CEL ORing semantics.
 //
 // If the value is true, the decision is finalized as no additional information can change the
-// aggregation result.
-func (or *OrAggregator) Aggregate(prg cel.Program, vars interpreter.Activation,
-	prev model.DecisionValue, rule model.Rule) (model.DecisionValue, error) {
-	val, det, _ := prg.Eval(vars)
+// aggregation result. Evaluation errors are returned rather than combined into the decision so
+// that the error disposition configured for the decision determines the outcome.
+func (or *OrAggregator) AggregateSource(prg cel.Program, vars interpreter.Activation,
+	prev model.DecisionValue, src *model.DecisionSource) (model.DecisionValue, error) {
+	val, det, err := prg.Eval(vars)
+	if err != nil {
+		return nil, err
+	}
 	if val == types.False {
 		return prev, nil
 	}
-	var prevBool *model.BoolDecisionValue
-	if prev != or.defDec {
-		prevBool = prev.(*model.BoolDecisionValue)
-	} else {
-		prevBool = model.NewBoolDecisionValue(or.name, types.False)
+	prevBool, ok := prev.(*model.BoolDecisionValue)
+	if !ok {
+		return nil, decisionTypeError(or.name, prev, "*model.BoolDecisionValue")
 	}
 	decVal := prevBool.Or(val)
 	if decVal.Value() == types.True {
-		decVal.Finalize(det, rule)
+		decVal.FinalizeWithSource(det, src)
 	}
 	return decVal, nil
 }
+
+// Merge ORs the next decision into the previous one unless the previous decision is final.
+func (or *OrAggregator) Merge(prev, next model.DecisionValue) (model.DecisionValue, error) {
+	return mergeBool(prev, next, (*model.BoolDecisionValue).Or)
+}
+
+// mergeBool combines boolean decisions with the given logical operator, carrying over the
+// finalization details and source of the next decision when it is final.
+func mergeBool(prev, next model.DecisionValue,
+	op func(*model.BoolDecisionValue, ref.Val) *model.BoolDecisionValue) (model.DecisionValue, error) {
+	if prev.IsFinal() {
+		return prev, nil
+	}
+	prevBool, ok := prev.(*model.BoolDecisionValue)
+	if !ok {
+		return nil, decisionTypeError(prev.Name(), prev, "*model.BoolDecisionValue")
+	}
+	nextBool, ok := next.(*model.BoolDecisionValue)
+	if !ok {
+		return nil, decisionTypeError(next.Name(), next, "*model.BoolDecisionValue")
+	}
+	decVal := op(prevBool, nextBool.Value())
+	if nextBool.IsFinal() {
+		decVal.FinalizeWithSource(nextBool.Details(), nextBool.Source())
+	}
+	return decVal, nil
+}
+
+// aggregate combines the previous decision with the value produced by the program, using the
+// SourceAggregator extension when the aggregator supports it.
+func aggregate(agg Aggregator,
+	prg cel.Program,
+	vars interpreter.Activation,
+	prev model.DecisionValue,
+	src *model.DecisionSource) (model.DecisionValue, error) {
+	if srcAgg, ok := agg.(SourceAggregator); ok {
+		return srcAgg.AggregateSource(prg, vars, prev, src)
+	}
+	var rule model.Rule
+	if src != nil {
+		rule = src.Rule
+	}
+	return agg.Aggregate(prg, vars, prev, rule)
+}
+
+// merge combines the previous decision with the next decision using the Merger extension, and
+// returns an error if the aggregator does not support merging.
+func merge(name string,
+	agg Aggregator,
+	prev, next model.DecisionValue) (model.DecisionValue, error) {
+	merger, ok := agg.(Merger)
+	if !ok {
+		return nil, fmt.Errorf("decision %s: aggregator %T does not implement Merger", name, agg)
+	}
+	return merger.Merge(prev, next)
+}
+
+// decisionTypeError returns an error for a decision value which the aggregator cannot combine,
+// such as a value produced by a different aggregator for the same decision name.
+func decisionTypeError(name string, dv model.DecisionValue, want string) error {
+	return fmt.Errorf("decision %s: got %T, wanted %s", name, dv, want)
+}
+
+// ruleSource returns a decision source which only describes the rule, or nil if the rule is nil.
+func ruleSource(rule model.Rule) *model.DecisionSource {
+	if rule == nil {
+		return nil
+	}
+	return &model.DecisionSource{Rule: rule}
+}
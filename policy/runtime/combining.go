@@ -0,0 +1,470 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"fmt"
+
+	"github.com/google/cel-policy-templates-go/policy/model"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
+	"github.com/google/cel-go/interpreter"
+)
+
+// The aggregators within this file combine the values emitted for a decision into a single
+// model.ValueDecisionValue.
+//
+// When either the previous or the next value is unknown, as may happen during partial evaluation,
+// the unknowns are combined into the decision value as the outcome cannot be determined. The one
+// exception is an OverridesAggregator value with the overriding effect, which determines the
+// outcome regardless of any other value, and so finalizes the decision even after an unknown.
+//
+// Numeric values of different types, e.g. an int and a double, are compared and added as doubles
+// since CEL only defines these operations for values of the same type.
+
+// NewFirstApplicableAggregator returns a TemplateOption which configures a
+// FirstApplicableAggregator for the given decision name.
+func NewFirstApplicableAggregator(name string) TemplateOption {
+	return DecisionAggregator(name, &FirstApplicableAggregator{name: name})
+}
+
+// FirstApplicableAggregator selects the first value emitted for the decision, and finalizes the
+// decision as soon as the value is emitted.
+type FirstApplicableAggregator struct {
+	name string
+}
+
+// DefaultDecision produces a decision without a value.
+func (fa *FirstApplicableAggregator) DefaultDecision() model.DecisionValue {
+	return model.NewValueDecisionValue(fa.name, nil, nil, nil)
+}
+
+// Aggregate implements the Aggregator interface method, recording the rule as the value source.
+func (fa *FirstApplicableAggregator) Aggregate(prg cel.Program, vars interpreter.Activation,
+	prev model.DecisionValue, rule model.Rule) (model.DecisionValue, error) {
+	return fa.AggregateSource(prg, vars, prev, ruleSource(rule))
+}
+
+// AggregateSource finalizes the decision with the value produced by the CEL program unless a value
+// has already been selected.
+func (fa *FirstApplicableAggregator) AggregateSource(prg cel.Program, vars interpreter.Activation,
+	prev model.DecisionValue, src *model.DecisionSource) (model.DecisionValue, error) {
+	next, err := evalValue(fa.name, prg, vars, src)
+	if err != nil {
+		return nil, err
+	}
+	return fa.Merge(prev, next)
+}
+
+// Merge keeps the previous value, if present, and otherwise selects the next value.
+func (fa *FirstApplicableAggregator) Merge(prev,
+	next model.DecisionValue) (model.DecisionValue, error) {
+	return mergeValues(fa.name, prev, next, nil,
+		func(p, n *model.ValueDecisionValue) (*model.ValueDecisionValue, error) {
+			if p != nil {
+				return p, nil
+			}
+			n.Finalize()
+			return n, nil
+		})
+}
+
+// NewDenyOverridesAggregator returns a TemplateOption which configures an OverridesAggregator for
+// the given decision name where 'deny' effects override 'permit' effects.
+func NewDenyOverridesAggregator(name string) TemplateOption {
+	return DecisionAggregator(name, &OverridesAggregator{name: name, effect: denyEffect})
+}
+
+// NewPermitOverridesAggregator returns a TemplateOption which configures an OverridesAggregator
+// for the given decision name where 'permit' effects override 'deny' effects.
+func NewPermitOverridesAggregator(name string) TemplateOption {
+	return DecisionAggregator(name, &OverridesAggregator{name: name, effect: permitEffect})
+}
+
+// OverridesAggregator combines structured outputs with an 'effect' field whose value is either
+// 'deny' or 'permit'.
+//
+// The first output whose effect is the overriding effect is selected and finalizes the decision.
+// Until then, the first output with the other effect is selected.
+type OverridesAggregator struct {
+	name   string
+	effect string
+}
+
+// DefaultDecision produces a decision without a value.
+func (ov *OverridesAggregator) DefaultDecision() model.DecisionValue {
+	return model.NewValueDecisionValue(ov.name, nil, nil, nil)
+}
+
+// Aggregate implements the Aggregator interface method, recording the rule as the value source.
+func (ov *OverridesAggregator) Aggregate(prg cel.Program, vars interpreter.Activation,
+	prev model.DecisionValue, rule model.Rule) (model.DecisionValue, error) {
+	return ov.AggregateSource(prg, vars, prev, ruleSource(rule))
+}
+
+// AggregateSource combines the output produced by the CEL program with the previous decision, and
+// returns an error if the output does not have a valid effect.
+func (ov *OverridesAggregator) AggregateSource(prg cel.Program, vars interpreter.Activation,
+	prev model.DecisionValue, src *model.DecisionSource) (model.DecisionValue, error) {
+	next, err := evalValue(ov.name, prg, vars, src)
+	if err != nil {
+		return nil, err
+	}
+	if !types.IsUnknown(next.Value()) {
+		if _, err := effectOf(next.Value()); err != nil {
+			return nil, err
+		}
+	}
+	return ov.Merge(prev, next)
+}
+
+// Merge selects the next value if its effect overrides the previous value, or if there is no
+// previous value.
+func (ov *OverridesAggregator) Merge(prev, next model.DecisionValue) (model.DecisionValue, error) {
+	return mergeValues(ov.name, prev, next, ov.overrides,
+		func(p, n *model.ValueDecisionValue) (*model.ValueDecisionValue, error) {
+			if ov.overrides(n) {
+				n.Finalize()
+				return n, nil
+			}
+			if _, err := effectOf(n.Value()); err != nil {
+				return nil, err
+			}
+			if p != nil {
+				return p, nil
+			}
+			return n, nil
+		})
+}
+
+// overrides returns whether the value has the overriding effect.
+func (ov *OverridesAggregator) overrides(n *model.ValueDecisionValue) bool {
+	effect, err := effectOf(n.Value())
+	return err == nil && effect == ov.effect
+}
+
+// NewPriorityAggregator returns a TemplateOption which configures a PriorityAggregator for the
+// given decision name.
+func NewPriorityAggregator(name string) TemplateOption {
+	return DecisionAggregator(name, &PriorityAggregator{name: name})
+}
+
+// PriorityAggregator selects the structured output with the highest numeric 'priority' field.
+// When several outputs share the highest priority, the first one emitted is selected.
+type PriorityAggregator struct {
+	name string
+}
+
+// DefaultDecision produces a decision without a value.
+func (pa *PriorityAggregator) DefaultDecision() model.DecisionValue {
+	return model.NewValueDecisionValue(pa.name, nil, nil, nil)
+}
+
+// Aggregate implements the Aggregator interface method, recording the rule as the value source.
+func (pa *PriorityAggregator) Aggregate(prg cel.Program, vars interpreter.Activation,
+	prev model.DecisionValue, rule model.Rule) (model.DecisionValue, error) {
+	return pa.AggregateSource(prg, vars, prev, ruleSource(rule))
+}
+
+// AggregateSource combines the output produced by the CEL program with the previous decision, and
+// returns an error if the output does not have a comparable priority.
+func (pa *PriorityAggregator) AggregateSource(prg cel.Program, vars interpreter.Activation,
+	prev model.DecisionValue, src *model.DecisionSource) (model.DecisionValue, error) {
+	next, err := evalValue(pa.name, prg, vars, src)
+	if err != nil {
+		return nil, err
+	}
+	if !types.IsUnknown(next.Value()) {
+		if _, err := priorityOf(next.Value()); err != nil {
+			return nil, err
+		}
+	}
+	return pa.Merge(prev, next)
+}
+
+// Merge selects the next value if its priority is greater than the previous value.
+func (pa *PriorityAggregator) Merge(prev, next model.DecisionValue) (model.DecisionValue, error) {
+	return mergeValues(pa.name, prev, next, nil,
+		func(p, n *model.ValueDecisionValue) (*model.ValueDecisionValue, error) {
+			if p == nil {
+				return n, nil
+			}
+			pPri, err := priorityOf(p.Value())
+			if err != nil {
+				return nil, err
+			}
+			nPri, err := priorityOf(n.Value())
+			if err != nil {
+				return nil, err
+			}
+			cmp, err := compareNumbers(nPri, pPri)
+			if err != nil {
+				return nil, err
+			}
+			if cmp == types.IntOne {
+				return n, nil
+			}
+			return p, nil
+		})
+}
+
+// NewMinAggregator returns a TemplateOption which configures a NumericAggregator for the given
+// decision name which selects the minimum value emitted.
+func NewMinAggregator(name string) TemplateOption {
+	return DecisionAggregator(name, &NumericAggregator{name: name, op: minOp})
+}
+
+// NewMaxAggregator returns a TemplateOption which configures a NumericAggregator for the given
+// decision name which selects the maximum value emitted.
+func NewMaxAggregator(name string) TemplateOption {
+	return DecisionAggregator(name, &NumericAggregator{name: name, op: maxOp})
+}
+
+// NewSumAggregator returns a TemplateOption which configures a NumericAggregator for the given
+// decision name which adds the values emitted.
+func NewSumAggregator(name string) TemplateOption {
+	return DecisionAggregator(name, &NumericAggregator{name: name, op: sumOp})
+}
+
+// NewCountAggregator returns a TemplateOption which configures a NumericAggregator for the given
+// decision name which counts the number of values emitted.
+func NewCountAggregator(name string) TemplateOption {
+	return DecisionAggregator(name, &NumericAggregator{name: name, op: countOp})
+}
+
+// NumericAggregator combines the numeric values emitted for a decision by computing either their
+// minimum, maximum, sum, or count.
+//
+// The minimum and maximum retain the source of the selected value. When values are equal, the
+// first value emitted is selected. Sums and counts are not attributed to a single source.
+type NumericAggregator struct {
+	name string
+	op   numericOp
+}
+
+type numericOp int
+
+const (
+	minOp numericOp = iota + 1
+	maxOp
+	sumOp
+	countOp
+)
+
+// DefaultDecision produces a decision without a value.
+func (na *NumericAggregator) DefaultDecision() model.DecisionValue {
+	return model.NewValueDecisionValue(na.name, nil, nil, nil)
+}
+
+// Aggregate implements the Aggregator interface method, recording the rule as the value source.
+func (na *NumericAggregator) Aggregate(prg cel.Program, vars interpreter.Activation,
+	prev model.DecisionValue, rule model.Rule) (model.DecisionValue, error) {
+	return na.AggregateSource(prg, vars, prev, ruleSource(rule))
+}
+
+// AggregateSource combines the value produced by the CEL program with the previous decision.
+//
+// The output value is evaluated even when counting, so that evaluation errors are reported
+// consistently.
+func (na *NumericAggregator) AggregateSource(prg cel.Program, vars interpreter.Activation,
+	prev model.DecisionValue, src *model.DecisionSource) (model.DecisionValue, error) {
+	next, err := evalValue(na.name, prg, vars, src)
+	if err != nil {
+		return nil, err
+	}
+	if na.op == countOp && !types.IsUnknown(next.Value()) {
+		next = model.NewValueDecisionValue(na.name, types.IntOne, nil, nil)
+	}
+	return na.Merge(prev, next)
+}
+
+// Merge combines the previous and next values using the aggregator's numeric operation.
+func (na *NumericAggregator) Merge(prev, next model.DecisionValue) (model.DecisionValue, error) {
+	return mergeValues(na.name, prev, next, nil,
+		func(p, n *model.ValueDecisionValue) (*model.ValueDecisionValue, error) {
+			if err := na.checkNumeric(n.Value()); err != nil {
+				return nil, err
+			}
+			if p == nil {
+				return n, nil
+			}
+			if err := na.checkNumeric(p.Value()); err != nil {
+				return nil, err
+			}
+			switch na.op {
+			case minOp, maxOp:
+				res, err := compareNumbers(n.Value(), p.Value())
+				if err != nil {
+					return nil, err
+				}
+				if (na.op == minOp && res == types.IntNegOne) ||
+					(na.op == maxOp && res == types.IntOne) {
+					return n, nil
+				}
+				return p, nil
+			default:
+				sum, err := addNumbers(p.Value(), n.Value())
+				if err != nil {
+					return nil, err
+				}
+				return model.NewValueDecisionValue(na.name, sum, nil, nil), nil
+			}
+		})
+}
+
+func (na *NumericAggregator) checkNumeric(val ref.Val) error {
+	switch val.(type) {
+	case types.Int, types.Uint, types.Double:
+		return nil
+	default:
+		return fmt.Errorf("decision %s: got %v, wanted a numeric value", na.name, val)
+	}
+}
+
+// compareNumbers compares two numeric values, converting them to doubles when their types differ.
+func compareNumbers(a, b ref.Val) (ref.Val, error) {
+	a, b = sameNumericType(a, b)
+	cmp, ok := a.(traits.Comparer)
+	if !ok {
+		return nil, fmt.Errorf("got %v, wanted a numeric value", a)
+	}
+	res := cmp.Compare(b)
+	if types.IsError(res) {
+		return nil, fmt.Errorf("%v", res)
+	}
+	return res, nil
+}
+
+// addNumbers adds two numeric values, converting them to doubles when their types differ.
+func addNumbers(a, b ref.Val) (ref.Val, error) {
+	a, b = sameNumericType(a, b)
+	adder, ok := a.(traits.Adder)
+	if !ok {
+		return nil, fmt.Errorf("got %v, wanted a numeric value", a)
+	}
+	sum := adder.Add(b)
+	if types.IsError(sum) {
+		return nil, fmt.Errorf("%v", sum)
+	}
+	return sum, nil
+}
+
+// sameNumericType converts both values to doubles when their types differ.
+func sameNumericType(a, b ref.Val) (ref.Val, ref.Val) {
+	if a.Type() == b.Type() {
+		return a, b
+	}
+	return a.ConvertToType(types.DoubleType), b.ConvertToType(types.DoubleType)
+}
+
+// evalValue evaluates the program and wraps the result as a single value decision.
+func evalValue(name string,
+	prg cel.Program,
+	vars interpreter.Activation,
+	src *model.DecisionSource) (*model.ValueDecisionValue, error) {
+	val, det, err := prg.Eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	return model.NewValueDecisionValue(name, val, det, src), nil
+}
+
+// mergeValues combines the previous and next single value decisions using the choose function.
+//
+// Final decisions are retained, and unknown values are combined unless the known next value
+// satisfies the optional overrides function, in which case the next value is finalized. Otherwise,
+// the choose function selects the resulting value, where the previous value is nil if no value
+// has been produced.
+func mergeValues(name string,
+	prev, next model.DecisionValue,
+	overrides func(n *model.ValueDecisionValue) bool,
+	choose func(p, n *model.ValueDecisionValue) (*model.ValueDecisionValue, error),
+) (model.DecisionValue, error) {
+	p, ok := prev.(*model.ValueDecisionValue)
+	if !ok {
+		return nil, decisionTypeError(name, prev, "*model.ValueDecisionValue")
+	}
+	n, ok := next.(*model.ValueDecisionValue)
+	if !ok {
+		return nil, decisionTypeError(name, next, "*model.ValueDecisionValue")
+	}
+	if p.IsFinal() || n.Value() == nil {
+		return p, nil
+	}
+	pUnk, pIsUnk := p.Value().(types.Unknown)
+	nUnk, nIsUnk := n.Value().(types.Unknown)
+	if pIsUnk && !nIsUnk && overrides != nil && overrides(n) {
+		n.Finalize()
+		return n, nil
+	}
+	if pIsUnk || nIsUnk {
+		unk := append(types.Unknown{}, pUnk...)
+		unk = append(unk, nUnk...)
+		return model.NewValueDecisionValue(name, unk, nil, nil), nil
+	}
+	if p.Value() == nil {
+		p = nil
+	}
+	dv, err := choose(p, n)
+	if err != nil {
+		return nil, err
+	}
+	return dv, nil
+}
+
+const (
+	denyEffect   = "deny"
+	permitEffect = "permit"
+)
+
+// effectOf returns the 'effect' field of a structured output.
+func effectOf(val ref.Val) (string, error) {
+	effect, found := fieldOf(val, "effect")
+	if found {
+		if str, ok := effect.(types.String); ok &&
+			(str == denyEffect || str == permitEffect) {
+			return string(str), nil
+		}
+	}
+	return "", fmt.Errorf("got effect %v, wanted '%s' or '%s'", effect, denyEffect, permitEffect)
+}
+
+// priorityOf returns the numeric 'priority' field of a structured output.
+func priorityOf(val ref.Val) (ref.Val, error) {
+	pri, found := fieldOf(val, "priority")
+	if found {
+		switch pri.(type) {
+		case types.Int, types.Uint, types.Double:
+			return pri, nil
+		}
+	}
+	return nil, fmt.Errorf("got priority %v, wanted a numeric value", pri)
+}
+
+// fieldOf returns the value of the field within a map or message value, if present.
+func fieldOf(val ref.Val, field string) (ref.Val, bool) {
+	switch v := val.(type) {
+	case traits.Mapper:
+		return v.Find(types.String(field))
+	case traits.Indexer:
+		fv := v.Get(types.String(field))
+		return fv, !types.IsError(fv)
+	default:
+		return nil, false
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/cel-policy-templates-go/policy/model"
+
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+func TestCombiningAggregators(t *testing.T) {
+	deny := effect("deny")
+	permit := effect("permit")
+	unk := types.Unknown{1}
+	tests := []struct {
+		name  string
+		agg   Aggregator
+		vals  []ref.Val
+		want  ref.Val
+		final bool
+		err   string
+	}{
+		{
+			name:  "first_applicable",
+			agg:   &FirstApplicableAggregator{name: "d"},
+			vals:  []ref.Val{types.Int(1), types.Int(2)},
+			want:  types.Int(1),
+			final: true,
+		},
+		{
+			name: "first_applicable_after_unknown",
+			agg:  &FirstApplicableAggregator{name: "d"},
+			vals: []ref.Val{unk, types.Int(2)},
+			want: unk,
+		},
+		{
+			name:  "deny_overrides",
+			agg:   &OverridesAggregator{name: "d", effect: denyEffect},
+			vals:  []ref.Val{permit, deny, permit},
+			want:  deny,
+			final: true,
+		},
+		{
+			name: "deny_overrides_without_deny",
+			agg:  &OverridesAggregator{name: "d", effect: denyEffect},
+			vals: []ref.Val{permit, permit},
+			want: permit,
+		},
+		{
+			name:  "deny_overrides_after_unknown",
+			agg:   &OverridesAggregator{name: "d", effect: denyEffect},
+			vals:  []ref.Val{permit, unk, deny},
+			want:  deny,
+			final: true,
+		},
+		{
+			name: "deny_overrides_permit_after_unknown",
+			agg:  &OverridesAggregator{name: "d", effect: denyEffect},
+			vals: []ref.Val{unk, permit},
+			want: unk,
+		},
+		{
+			name:  "permit_overrides",
+			agg:   &OverridesAggregator{name: "d", effect: permitEffect},
+			vals:  []ref.Val{deny, permit},
+			want:  permit,
+			final: true,
+		},
+		{
+			name: "invalid_effect",
+			agg:  &OverridesAggregator{name: "d", effect: denyEffect},
+			vals: []ref.Val{permit, effect("allow")},
+			err:  "got effect allow",
+		},
+		{
+			name: "priority_mixed_types",
+			agg:  &PriorityAggregator{name: "d"},
+			vals: []ref.Val{priority(1), priority(1.5), priority(uint64(1))},
+			want: priority(1.5),
+		},
+		{
+			name: "min_mixed_types",
+			agg:  &NumericAggregator{name: "d", op: minOp},
+			vals: []ref.Val{types.Int(3), types.Double(1.5), types.Uint(2)},
+			want: types.Double(1.5),
+		},
+		{
+			name: "max_mixed_types",
+			agg:  &NumericAggregator{name: "d", op: maxOp},
+			vals: []ref.Val{types.Double(2.5), types.Int(3), types.Uint(1)},
+			want: types.Int(3),
+		},
+		{
+			name: "sum",
+			agg:  &NumericAggregator{name: "d", op: sumOp},
+			vals: []ref.Val{types.Int(1), types.Int(2)},
+			want: types.Int(3),
+		},
+		{
+			name: "sum_mixed_types",
+			agg:  &NumericAggregator{name: "d", op: sumOp},
+			vals: []ref.Val{types.Int(1), types.Double(0.5)},
+			want: types.Double(1.5),
+		},
+		{
+			name: "sum_with_unknown",
+			agg:  &NumericAggregator{name: "d", op: sumOp},
+			vals: []ref.Val{types.Int(1), unk, types.Int(2)},
+			want: unk,
+		},
+		{
+			name: "sum_not_numeric",
+			agg:  &NumericAggregator{name: "d", op: sumOp},
+			vals: []ref.Val{types.Int(1), types.String("2")},
+			err:  "wanted a numeric value",
+		},
+	}
+	for _, tc := range tests {
+		tst := tc
+		t.Run(tst.name, func(tt *testing.T) {
+			merger := tst.agg.(Merger)
+			dv := tst.agg.DefaultDecision()
+			var err error
+			for _, val := range tst.vals {
+				dv, err = merger.Merge(dv, model.NewValueDecisionValue("d", val, nil, nil))
+				if err != nil {
+					break
+				}
+			}
+			if tst.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tst.err) {
+					tt.Fatalf("got error %v, wanted %s", err, tst.err)
+				}
+				return
+			}
+			if err != nil {
+				tt.Fatal(err)
+			}
+			got := dv.(*model.ValueDecisionValue)
+			if !reflect.DeepEqual(got.Value(), tst.want) {
+				tt.Errorf("got %v, wanted %v", got.Value(), tst.want)
+			}
+			if got.IsFinal() != tst.final {
+				tt.Errorf("got final=%t, wanted %t", got.IsFinal(), tst.final)
+			}
+		})
+	}
+}
+
+func effect(eff string) ref.Val {
+	return types.DefaultTypeAdapter.NativeToValue(map[string]string{"effect": eff})
+}
+
+func priority(pri interface{}) ref.Val {
+	return types.DefaultTypeAdapter.NativeToValue(map[string]interface{}{"priority": pri})
+}
@@ -0,0 +1,339 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/cel-policy-templates-go/policy/model"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+// ErrorKind identifies the kind of template element whose evaluation failed.
+type ErrorKind string
+
+const (
+	// InstanceError indicates a failure which is not specific to a template expression, such as
+	// an instance which exceeds the rule limit.
+	InstanceError ErrorKind = "instance"
+
+	// RangeError indicates a failure to evaluate an evaluator range expression.
+	RangeError ErrorKind = "range"
+
+	// TermError indicates a failure to evaluate a term referenced by a failing match, output, or
+	// decision reference.
+	TermError ErrorKind = "term"
+
+	// MatchError indicates a failure to evaluate a production match expression.
+	MatchError ErrorKind = "match"
+
+	// OutputError indicates a failure to evaluate or aggregate a decision output.
+	OutputError ErrorKind = "output"
+
+	// DecisionRefError indicates a failure to compute a decision name from a decision reference.
+	DecisionRefError ErrorKind = "decisionRef"
+)
+
+// EvalError describes a failure to evaluate a template element for a policy instance.
+type EvalError struct {
+	// Kind identifies the template element which failed.
+	Kind ErrorKind
+
+	// Name is the term or decision name associated with the failure, if any.
+	Name string
+
+	// Source describes the template, instance, rule, and production under evaluation. The
+	// production fields are only set for match, output, and decision reference errors.
+	Source *model.DecisionSource
+
+	// Location is the location of the failing expression within the template source, if known.
+	Location common.Location
+
+	// Err is the underlying evaluation error.
+	Err error
+}
+
+// Error implements the error interface method.
+func (e *EvalError) Error() string {
+	var buf strings.Builder
+	if src := e.Source; src != nil {
+		buf.WriteString(src.Template)
+		if src.InstanceName != "" {
+			buf.WriteString("/")
+			if src.InstanceNamespace != "" {
+				buf.WriteString(src.InstanceNamespace)
+				buf.WriteString("/")
+			}
+			buf.WriteString(src.InstanceName)
+		}
+		if src.InstanceSource != "" {
+			buf.WriteString(fmt.Sprintf(" (%s)", src.InstanceSource))
+		}
+		if src.Rule != nil {
+			buf.WriteString(fmt.Sprintf(" rule[%d]", src.Rule.GetID()))
+			writeLocation(&buf, src.RuleLocation)
+		}
+		buf.WriteString(": ")
+	}
+	buf.WriteString(string(e.Kind))
+	if e.Name != "" {
+		buf.WriteString(" ")
+		buf.WriteString(e.Name)
+	}
+	writeLocation(&buf, e.Location)
+	buf.WriteString(fmt.Sprintf(": %v", e.Err))
+	return buf.String()
+}
+
+// Unwrap returns the underlying evaluation error.
+func (e *EvalError) Unwrap() error {
+	return e.Err
+}
+
+// EvalErrors lists the errors encountered while evaluating one or more policy instances, in
+// evaluation order.
+type EvalErrors []*EvalError
+
+// Error implements the error interface method.
+func (errs EvalErrors) Error() string {
+	if len(errs) == 1 {
+		return errs[0].Error()
+	}
+	var buf strings.Builder
+	buf.WriteString(fmt.Sprintf("%d evaluation errors:", len(errs)))
+	for _, e := range errs {
+		buf.WriteString("\n\t")
+		buf.WriteString(e.Error())
+	}
+	return buf.String()
+}
+
+// append adds the error to the list, flattening nested EvalErrors values.
+func (errs EvalErrors) append(err error) EvalErrors {
+	switch e := err.(type) {
+	case EvalErrors:
+		return append(errs, e...)
+	case *EvalError:
+		return append(errs, e)
+	default:
+		return append(errs, &EvalError{Kind: InstanceError, Err: err})
+	}
+}
+
+// evalError creates an EvalError for the rule under evaluation and the given production, if any.
+func (ctx *ruleActivation) evalError(p *prod,
+	kind ErrorKind,
+	name string,
+	loc common.Location,
+	err error) *EvalError {
+	return &EvalError{
+		Kind:     kind,
+		Name:     name,
+		Source:   ctx.decisionSource(p),
+		Location: loc,
+		Err:      err,
+	}
+}
+
+// termErrors returns the errors of the terms referenced directly or indirectly by the expression
+// which failed during the current evaluation pass. Each term error is only reported once per pass.
+func (eval *evaluator) termErrors(act *evaluatorActivation, ast *cel.Ast) EvalErrors {
+	if act.termErrCnt == 0 || ast == nil {
+		return nil
+	}
+	refs := &residualRefs{
+		idents: map[string]struct{}{},
+		chains: map[string]struct{}{},
+	}
+	refs.collect(ast.Expr())
+	visited := map[string]struct{}{}
+	for added := true; added; {
+		added = false
+		for name := range refs.idents {
+			t, found := eval.termMap[name]
+			if _, seen := visited[name]; !found || seen {
+				continue
+			}
+			visited[name] = struct{}{}
+			refs.collect(t.ast.Expr())
+			added = true
+		}
+	}
+	var errs EvalErrors
+	for _, t := range eval.terms {
+		if _, found := visited[t.name]; !found {
+			continue
+		}
+		if err := act.termErrs[t.slot]; err != nil {
+			errs = append(errs, err)
+			act.termErrs[t.slot] = nil
+			act.termErrCnt--
+		}
+	}
+	return errs
+}
+
+// exprLocation returns the location of the expression within the template source, if known.
+func exprLocation(ast *cel.Ast) common.Location {
+	if ast == nil {
+		return common.NoLocation
+	}
+	if rel, ok := ast.Source().(*model.RelativeSource); ok {
+		return rel.AbsoluteLocation()
+	}
+	return common.NoLocation
+}
+
+// CostLimitError indicates that an evaluation was aborted as its cost exceeded the limit.
+type CostLimitError struct {
+	// Limit is the cost limit of the evaluation.
+	Limit int64
+}
+
+// Error implements the error interface method.
+func (e *CostLimitError) Error() string {
+	return fmt.Sprintf("evaluation cost limit set to %d, but exceeded", e.Limit)
+}
+
+// ErrorDisposition determines how an evaluation error affects a decision.
+type ErrorDisposition struct {
+	skip  bool
+	value ref.Val
+}
+
+// SurfaceError returns an ErrorDisposition which reports evaluation errors to the caller. This is
+// the default disposition for all decisions.
+func SurfaceError() *ErrorDisposition {
+	return &ErrorDisposition{}
+}
+
+// SkipError returns an ErrorDisposition which ignores the failed contribution to the decision.
+//
+// For example, skipping errors for an OR-aggregated 'policy.deny' decision fails open.
+func SkipError() *ErrorDisposition {
+	return &ErrorDisposition{skip: true}
+}
+
+// ErrorValue returns an ErrorDisposition which aggregates the given value into the decision in
+// place of the failed contribution.
+//
+// For example, using the value true for an OR-aggregated 'policy.deny' decision fails closed.
+func ErrorValue(val interface{}) *ErrorDisposition {
+	return &ErrorDisposition{value: types.DefaultTypeAdapter.NativeToValue(val)}
+}
+
+// recoverError applies the error disposition configured for the decision, and returns whether the
+// error was handled. Errors which are not handled should be surfaced to the caller.
+func (eval *evaluator) recoverError(ev *Evaluation,
+	name string,
+	slot int,
+	act *evaluatorActivation,
+	slots *decisionSlots,
+	src *model.DecisionSource) (bool, error) {
+	disp, found := eval.errDisps[name]
+	if !found || (!disp.skip && disp.value == nil) {
+		return false, nil
+	}
+	if disp.skip {
+		return true, nil
+	}
+	agg := eval.aggregator(name)
+	dv := eval.current(ev, slots, name, slot)
+	if dv == nil {
+		dv = agg.DefaultDecision()
+	}
+	dv, err := aggregate(agg, &valueProgram{val: disp.value}, act, dv, src)
+	if err != nil {
+		return false, err
+	}
+	eval.update(slots, name, slot, dv)
+	return true, nil
+}
+
+// recoverMatchError applies the error dispositions of the selected decisions emitted by the
+// production whose match failed to evaluate, and returns whether the match error was handled by
+// all of them.
+func (eval *evaluator) recoverMatchError(ev *Evaluation,
+	p *prod,
+	vars *ruleActivation,
+	act *evaluatorActivation,
+	slots *decisionSlots) (bool, error) {
+	if len(eval.errDisps) == 0 {
+		return false, nil
+	}
+	src := vars.decisionSource(p)
+	recovered := true
+	for _, d := range p.decisions {
+		name, slot, refErrs := eval.resolveDecision(p, d, act)
+		if refErrs != nil {
+			return false, refErrs
+		}
+		if !ev.Selects(name) {
+			continue
+		}
+		if eval.isFinal(ev, slots, name, slot) {
+			continue
+		}
+		ok, err := eval.recoverError(ev, name, slot, act, slots, src)
+		if err != nil {
+			return false, err
+		}
+		recovered = recovered && ok
+	}
+	return recovered, nil
+}
+
+// recoverRangeError applies the error dispositions of the selected, statically named decisions
+// of the evaluator when a range fails to evaluate, and returns the range error unless it was
+// handled by all of them. Range errors are always surfaced for evaluators which produce decisions
+// via decision references, as the affected decision names are not known.
+func (eval *evaluator) recoverRangeError(ev *Evaluation,
+	vars *ruleActivation,
+	slots *decisionSlots,
+	err error) error {
+	var errs EvalErrors
+	if len(eval.errDisps) == 0 || eval.hasRefs {
+		return errs.append(err)
+	}
+	act := eval.actPool.Setup(vars)
+	defer eval.actPool.Put(act)
+	src := vars.decisionSource(nil)
+	recovered := true
+	for i, name := range eval.slotNames {
+		if !ev.Selects(name) {
+			continue
+		}
+		if eval.isFinal(ev, slots, name, i) {
+			continue
+		}
+		ok, recErr := eval.recoverError(ev, name, i, act, slots, src)
+		if recErr != nil {
+			errs = errs.append(recErr)
+		}
+		recovered = recovered && ok
+	}
+	if !recovered {
+		errs = errs.append(err)
+	}
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
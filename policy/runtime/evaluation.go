@@ -0,0 +1,344 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/cel-policy-templates-go/policy/model"
+
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/interpreter"
+)
+
+// NewEvaluation creates an Evaluation which accumulates the decisions produced by one or more
+// template instances on behalf of a single policy evaluation.
+//
+// The context bounds the lifetime of the evaluation, and the selector, if non-nil, restricts the
+// set of decisions which will be computed. The evaluation time is the time of the call unless
+// otherwise set via SetTime.
+func NewEvaluation(ctx context.Context, selector model.DecisionSelector) *Evaluation {
+	return &Evaluation{
+		ctx:      ctx,
+		selector: selector,
+		now:      types.Timestamp{Time: time.Now()},
+		values:   map[string]model.DecisionValue{},
+		budget:   &costBudget{limit: -1},
+		terms:    &termCache{vals: map[*term]ref.Val{}},
+	}
+}
+
+// Evaluation holds the decisions aggregated across the templates and instances evaluated on
+// behalf of a single policy evaluation.
+//
+// Decisions with the same name are combined using the Aggregator configured for the decision,
+// so the output of evaluating several instances is a single value per decision name.
+//
+// Terms which depend only on the input are evaluated at most once per Evaluation and their values
+// are shared across the instances of the template, so every instance evaluated with the same
+// Evaluation, or its forks, must be evaluated against the same input variables.
+//
+// Evaluation values are not concurrency-safe.
+type Evaluation struct {
+	ctx      context.Context
+	selector model.DecisionSelector
+	// now holds the evaluation time as a types.Timestamp.
+	now    ref.Val
+	names  []string
+	values map[string]model.DecisionValue
+	trace  *Trace
+	// budget tracks the cost of the evaluation and is shared with forked evaluations.
+	budget *costBudget
+	// terms caches the values of input-only terms and is shared with forked evaluations.
+	terms *termCache
+	// unknowns and residuals support partial evaluation.
+	unknowns  []*interpreter.AttributePattern
+	residuals []*Residual
+	contOnErr bool
+	advisory  bool
+}
+
+// Context returns the context associated with the evaluation.
+func (ev *Evaluation) Context() context.Context {
+	return ev.ctx
+}
+
+// Err returns the reason the evaluation was interrupted, if any. This is either the context error,
+// or a *CostLimitError once the cost of the evaluation exceeds its limit.
+func (ev *Evaluation) Err() error {
+	if err := ev.ctx.Err(); err != nil {
+		return err
+	}
+	return ev.budget.err()
+}
+
+// Time returns the evaluation time, which is exposed to template expressions as the 'now'
+// variable.
+func (ev *Evaluation) Time() time.Time {
+	return ev.now.(types.Timestamp).Time
+}
+
+// SetTime sets the evaluation time.
+func (ev *Evaluation) SetTime(now time.Time) {
+	ev.now = types.Timestamp{Time: now}
+}
+
+// SetCostLimit limits the actual cost of the evaluation, including the cost of any evaluations
+// forked from it. Each range iteration and each evaluation of a term, production match, decision
+// reference, or decision output costs one unit. A negative limit is equivalent to unlimited.
+//
+// Term values which are not evaluated, because they were prepared by Template.PrepareInstance or
+// are shared with an instance evaluated earlier, do not add to the cost.
+//
+// Once the cost exceeds the limit, evaluation stops and returns a *CostLimitError in the same
+// manner as when the evaluation context is cancelled.
+func (ev *Evaluation) SetCostLimit(limit int) {
+	ev.budget.limit = int64(limit)
+}
+
+// SetContinueOnError configures whether the evaluation of the remaining instances continues when
+// the evaluation of an instance fails. The setting is interpreted by the caller which evaluates
+// the instances, such as the policy.Engine.
+func (ev *Evaluation) SetContinueOnError(contOnErr bool) {
+	ev.contOnErr = contOnErr
+}
+
+// ContinueOnError reports whether evaluation should continue past failing instances.
+func (ev *Evaluation) ContinueOnError() bool {
+	return ev.contOnErr
+}
+
+// SetIncludeAdvisories configures whether the instances with an advisory enforcement action are
+// evaluated along with the enforced instances. As with SetContinueOnError, the setting is
+// interpreted by the caller which evaluates the instances.
+func (ev *Evaluation) SetIncludeAdvisories(advisory bool) {
+	ev.advisory = advisory
+}
+
+// IncludeAdvisories reports whether the advisory instances should be evaluated.
+func (ev *Evaluation) IncludeAdvisories() bool {
+	return ev.advisory
+}
+
+// Cost returns the cost incurred by the evaluation and its forks so far.
+func (ev *Evaluation) Cost() int64 {
+	return atomic.LoadInt64(&ev.budget.used)
+}
+
+// Fork creates an empty Evaluation with the same decision selector, evaluation time, and tracing
+// configuration as the current evaluation, but bound to the given context.
+//
+// Forked evaluations may be used to evaluate instances concurrently, one Evaluation per
+// goroutine, with the results combined via Template.MergeEvaluation.
+func (ev *Evaluation) Fork(ctx context.Context) *Evaluation {
+	forked := NewEvaluation(ctx, ev.selector)
+	forked.now = ev.now
+	forked.budget = ev.budget
+	forked.terms = ev.terms
+	forked.unknowns = ev.unknowns
+	forked.contOnErr = ev.contOnErr
+	forked.advisory = ev.advisory
+	if ev.trace != nil {
+		forked.EnableTrace()
+	}
+	return forked
+}
+
+// SetUnknowns declares the input attributes which should be treated as unknown.
+//
+// Templates must be configured with the PartialEval option for unknowns to be recognized. When
+// a production match or decision output depends on an unknown attribute, the decision records a
+// types.Unknown value and a Residual which explains the attributes needed to resolve it.
+func (ev *Evaluation) SetUnknowns(unknowns ...*interpreter.AttributePattern) {
+	ev.unknowns = unknowns
+}
+
+// Residuals returns the residuals recorded for decisions which depend on unknown attributes, in
+// evaluation order.
+func (ev *Evaluation) Residuals() []*Residual {
+	return ev.residuals
+}
+
+// EnableTrace configures the evaluation to record a Trace of the instances, rules, range
+// bindings, terms, and productions evaluated along with the decisions emitted.
+func (ev *Evaluation) EnableTrace() {
+	if ev.trace == nil {
+		ev.trace = &Trace{}
+	}
+}
+
+// Trace returns the recorded evaluation trace, or nil if tracing was not enabled.
+func (ev *Evaluation) Trace() *Trace {
+	return ev.trace
+}
+
+// Decision returns the decision value for the given name, if present.
+func (ev *Evaluation) Decision(name string) (model.DecisionValue, bool) {
+	dv, found := ev.values[name]
+	return dv, found
+}
+
+// Decisions returns the decision values in the order in which they were first produced.
+func (ev *Evaluation) Decisions() []model.DecisionValue {
+	var decisions []model.DecisionValue
+	for _, name := range ev.names {
+		decisions = append(decisions, ev.values[name])
+	}
+	return decisions
+}
+
+// FinalDecisions returns the finalized decision values in the order in which they were first
+// produced.
+func (ev *Evaluation) FinalDecisions() []model.DecisionValue {
+	var decisions []model.DecisionValue
+	for _, name := range ev.names {
+		dv := ev.values[name]
+		if dv.IsFinal() {
+			decisions = append(decisions, dv)
+		}
+	}
+	return decisions
+}
+
+// IsFinal returns whether all of the named decisions have been produced and finalized.
+//
+// When all of the decisions of interest are final, evaluating additional instances will not
+// change the outcome of the evaluation.
+func (ev *Evaluation) IsFinal(names ...string) bool {
+	for _, name := range names {
+		dv, found := ev.values[name]
+		if !found || !dv.IsFinal() {
+			return false
+		}
+	}
+	return true
+}
+
+// Selects returns whether the decision name is part of the requested decision set.
+func (ev *Evaluation) Selects(name string) bool {
+	return ev.selector == nil || ev.selector(name)
+}
+
+// traceInstance records the start of an instance evaluation within the trace, if enabled.
+func (ev *Evaluation) traceInstance(tmpl *model.Template, inst *model.Instance) *InstanceTrace {
+	if ev.trace == nil {
+		return nil
+	}
+	it := &InstanceTrace{Template: tmpl.Metadata.Name}
+	if inst.Metadata != nil {
+		it.InstanceNamespace = inst.Metadata.Namespace
+		it.InstanceName = inst.Metadata.Name
+	}
+	if info, ok := inst.Meta.(*model.SourceInfo); ok {
+		it.InstanceSource = info.Description
+	}
+	ev.trace.Instances = append(ev.trace.Instances, it)
+	return it
+}
+
+// seedSlots initializes the decision slots with the values previously aggregated for the
+// decisions by name.
+func (ev *Evaluation) seedSlots(names []string, slots *decisionSlots) {
+	for i, name := range names {
+		dv, found := ev.values[name]
+		if found {
+			slots.values[i] = dv
+		}
+	}
+}
+
+// collectSlots records the decision slot values by name, followed by the referenced decision
+// values, noting the order in which new decisions are first observed.
+func (ev *Evaluation) collectSlots(names []string, slots *decisionSlots) {
+	for i, name := range names {
+		ev.collect(name, slots.values[i])
+	}
+	for _, name := range slots.refNames {
+		ev.collect(name, slots.refValues[name])
+	}
+}
+
+func (ev *Evaluation) collect(name string, dv model.DecisionValue) {
+	if dv == nil {
+		return
+	}
+	if _, found := ev.values[name]; !found {
+		ev.names = append(ev.names, name)
+	}
+	ev.values[name] = dv
+}
+
+// costBudget tracks the cost of an evaluation against its limit. Budgets are shared between an
+// evaluation and its forks, and so may be charged concurrently.
+type costBudget struct {
+	limit int64
+	used  int64
+}
+
+// charge adds the cost to the budget, and returns a *CostLimitError if the limit is exceeded.
+//
+// A nil budget, as used during template validation, is unlimited.
+func (b *costBudget) charge(cost int64) error {
+	if b == nil {
+		return nil
+	}
+	used := atomic.AddInt64(&b.used, cost)
+	if b.limit >= 0 && used > b.limit {
+		return &CostLimitError{Limit: b.limit}
+	}
+	return nil
+}
+
+// err returns a *CostLimitError if the limit has been exceeded.
+func (b *costBudget) err() error {
+	if b.limit >= 0 && atomic.LoadInt64(&b.used) > b.limit {
+		return &CostLimitError{Limit: b.limit}
+	}
+	return nil
+}
+
+// termCache holds the values of the terms which depend only on the evaluation input. Caches are
+// shared between an evaluation and its forks, and so may be accessed concurrently.
+type termCache struct {
+	mu   sync.RWMutex
+	vals map[*term]ref.Val
+}
+
+// load returns the cached value of the term, if present.
+//
+// A nil cache, as used when preparing rule terms, never contains a value.
+func (c *termCache) load(t *term) (ref.Val, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.RLock()
+	val, found := c.vals[t]
+	c.mu.RUnlock()
+	return val, found
+}
+
+// store caches the value of the term.
+func (c *termCache) store(t *term, val ref.Val) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.vals[t] = val
+	c.mu.Unlock()
+}
@@ -0,0 +1,181 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"fmt"
+
+	"github.com/google/cel-policy-templates-go/policy/model"
+
+	"github.com/google/cel-go/common"
+)
+
+// FinalizationScope determines how far the finalization of a decision extends.
+//
+// Once a decision is finalized within its scope, the remaining productions which contribute to
+// the decision within the scope are skipped. The values aggregated within a rule or instance
+// scope are merged into the decision when the scope ends, so a finalized rule does not suppress
+// the contributions of the rules which follow it.
+type FinalizationScope int
+
+const (
+	// PolicySetScope finalizes the decision for all of the templates and instances within the
+	// evaluation. This is the default scope for all decisions.
+	PolicySetScope FinalizationScope = iota
+
+	// InstanceScope finalizes the decision for the remaining rules of the instance under
+	// evaluation.
+	InstanceScope
+
+	// RuleScope finalizes the decision for the remaining range iterations and productions of the
+	// rule under evaluation.
+	RuleScope
+)
+
+// declaredScopes maps the finalization scopes which may be declared within a template to their
+// runtime equivalents.
+var declaredScopes = map[string]FinalizationScope{
+	model.FinalizePolicySet: PolicySetScope,
+	model.FinalizeInstance:  InstanceScope,
+	model.FinalizeRule:      RuleScope,
+}
+
+// String returns the name of the scope as declared within a template.
+func (s FinalizationScope) String() string {
+	for name, scope := range declaredScopes {
+		if s == scope {
+			return name
+		}
+	}
+	return fmt.Sprintf("FinalizationScope(%d)", int(s))
+}
+
+// declareScope configures the finalization scope declared by the template, and returns an error
+// if a different scope was configured for the decision via a TemplateOption.
+func (t *Template) declareScope(d *model.DecisionDecl) (*Template, error) {
+	scope, found := declaredScopes[d.Finalize]
+	if !found {
+		return nil, fmt.Errorf("decision %s: unsupported finalization scope: %s",
+			d.Name, d.Finalize)
+	}
+	prev, configured := t.finScopes[d.Name]
+	if configured && prev != scope {
+		return nil, fmt.Errorf(
+			"decision %s: configured finalization scope %s conflicts with declared scope: %s",
+			d.Name, prev, d.Finalize)
+	}
+	if scope != PolicySetScope {
+		t.finScopes[d.Name] = scope
+	}
+	return t, nil
+}
+
+// scope returns the finalization scope of the decision.
+func (eval *evaluator) scope(name string) FinalizationScope {
+	if len(eval.finScopes) == 0 {
+		return PolicySetScope
+	}
+	return eval.finScopes[name]
+}
+
+// current returns the value onto which the next contribution to the decision should be
+// aggregated, or nil if the decision has not yet been produced within its scope.
+//
+// Decisions with a rule or instance scope are aggregated separately for each scope and merged
+// into the decision when the scope ends.
+func (eval *evaluator) current(ev *Evaluation,
+	slots *decisionSlots,
+	name string,
+	slot int) model.DecisionValue {
+	if eval.scope(name) == PolicySetScope {
+		return slots.get(ev, name, slot)
+	}
+	return slots.scoped[name]
+}
+
+// update records the value aggregated for the decision within its scope.
+func (eval *evaluator) update(slots *decisionSlots,
+	name string,
+	slot int,
+	dv model.DecisionValue) {
+	if eval.scope(name) == PolicySetScope {
+		slots.set(name, slot, dv)
+		return
+	}
+	if _, found := slots.scoped[name]; !found {
+		slots.scopedNames = append(slots.scopedNames, name)
+	}
+	slots.scoped[name] = dv
+}
+
+// isFinal returns whether the decision has been finalized, either within the evaluation or within
+// its finalization scope.
+func (eval *evaluator) isFinal(ev *Evaluation,
+	slots *decisionSlots,
+	name string,
+	slot int) bool {
+	if dv := slots.get(ev, name, slot); dv != nil && dv.IsFinal() {
+		return true
+	}
+	if eval.scope(name) == PolicySetScope {
+		return false
+	}
+	dv, found := slots.scoped[name]
+	return found && dv.IsFinal()
+}
+
+// closeScope merges the values aggregated for decisions whose scope is at least as narrow as the
+// given scope into their decisions, in the order the decisions were produced within the scope.
+func (eval *evaluator) closeScope(ev *Evaluation,
+	vars *ruleActivation,
+	slots *decisionSlots,
+	scope FinalizationScope) error {
+	if len(slots.scopedNames) == 0 {
+		return nil
+	}
+	var errs EvalErrors
+	open := slots.scopedNames[:0]
+	for _, name := range slots.scopedNames {
+		if eval.scope(name) < scope {
+			open = append(open, name)
+			continue
+		}
+		next := slots.scoped[name]
+		delete(slots.scoped, name)
+		slot, found := eval.slotMap[name]
+		if !found {
+			slot = -1
+		}
+		agg := eval.aggregator(name)
+		// The decision is merged onto a default decision rather than adopting the scoped value
+		// so that the finalization of the scope does not finalize the decision unless the
+		// aggregator's merge dictates it.
+		prev := slots.get(ev, name, slot)
+		if prev == nil {
+			prev = agg.DefaultDecision()
+		}
+		dv, err := merge(name, agg, prev, next)
+		if err != nil {
+			errs = errs.append(vars.evalError(nil, OutputError, name, common.NoLocation, err))
+			continue
+		}
+		slots.set(name, slot, dv)
+	}
+	slots.scopedNames = open
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
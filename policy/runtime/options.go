@@ -32,6 +32,36 @@ func DecisionAggregator(decision string, agg Aggregator) TemplateOption {
 	}
 }
 
+// DecisionFinalization configures the scope within which the finalization of the decision with
+// the given name suppresses further contributions to the decision. By default, decisions are
+// finalized for the entire policy set.
+//
+// For example, a decision aggregated with NewCollectFirstAggregator and finalized per rule
+// collects at most one value for each rule. Scoped decisions are merged into the policy set
+// decision, so the decision aggregator must implement Merger.
+func DecisionFinalization(decision string, scope FinalizationScope) TemplateOption {
+	return func(t *Template) (*Template, error) {
+		if scope == PolicySetScope {
+			delete(t.finScopes, decision)
+			return t, nil
+		}
+		t.finScopes[decision] = scope
+		return t, nil
+	}
+}
+
+// DecisionErrorDisposition configures how evaluation errors affect the decision with the given
+// name. By default, errors are surfaced to the caller.
+//
+// The disposition applies when a production match or decision output fails to evaluate, as well
+// as when a range fails to evaluate, in which case it applies to all of the evaluator decisions.
+func DecisionErrorDisposition(decision string, disp *ErrorDisposition) TemplateOption {
+	return func(t *Template) (*Template, error) {
+		t.errDisps[decision] = disp
+		return t, nil
+	}
+}
+
 // ExprOptions configues a set of options for use with constructing CEL programs within the
 // template.
 func ExprOptions(opts ...cel.ProgramOption) TemplateOption {
@@ -57,3 +87,15 @@ func Limits(l *limits.Limits) TemplateOption {
 		return t, nil
 	}
 }
+
+// PartialEval configures the template runtime to support partial evaluation, where some input
+// attributes are declared unknown via Evaluation.SetUnknowns.
+//
+// Partially evaluated programs track their evaluation state in order to compute residual
+// expressions, which makes evaluation slower than for templates configured without this option.
+func PartialEval() TemplateOption {
+	return func(t *Template) (*Template, error) {
+		t.partial = true
+		return t, nil
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/google/cel-policy-templates-go/policy/model"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/interpreter"
+
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// Residual describes a contribution to a decision which could not be computed during partial
+// evaluation because the production match or the decision output depends on unknown attributes.
+//
+// The decision value records the contribution as a types.Unknown value, and the Residual explains
+// which attributes are needed to resolve it. The residual expressions have all known values
+// substituted as literals, so a downstream system may finish the evaluation by supplying the
+// unknown attributes: when Match evaluates to true, Output is the value contributed to Decision.
+type Residual struct {
+	// Decision is the name of the decision the residual contributes to.
+	Decision string
+
+	// Source describes the template, instance, rule, and production of the residual.
+	Source *model.DecisionSource
+
+	// Attributes lists the unknown attributes referenced by the residual expressions, sorted.
+	Attributes []string
+
+	// Match is the residual production match expression, 'true' if the match was known.
+	Match string
+
+	// Output is the residual decision output expression.
+	Output string
+
+	// Terms maps the names of the unknown terms referenced by the residual expressions to the
+	// residual term expressions.
+	Terms map[string]string
+}
+
+// residual records a Residual for the decision when either the match or the decision output are
+// unknown, and returns the program to be aggregated into the decision.
+//
+// The returned program yields the values computed here, so that the decision output is not
+// evaluated a second time by the aggregator.
+func (eval *evaluator) residual(ev *Evaluation,
+	p *prod,
+	d *decision,
+	name string,
+	src *model.DecisionSource,
+	act *evaluatorActivation,
+	match ref.Val,
+	matchDet *cel.EvalDetails) cel.Program {
+	out, outDet, err := d.prg.Eval(act)
+	unknownMatch := types.IsUnknown(match)
+	if !unknownMatch && !types.IsUnknown(out) {
+		return &valueProgram{val: out, det: outDet, err: err}
+	}
+	refs := &residualRefs{
+		idents: map[string]struct{}{},
+		chains: map[string]struct{}{},
+	}
+	res := &Residual{
+		Decision: name,
+		Source:   src,
+		Match:    "true",
+		Terms:    map[string]string{},
+	}
+	if unknownMatch {
+		res.Match = residualExpr(p.matchAst, matchDet, refs)
+	}
+	res.Output = residualExpr(d.ast, outDet, refs)
+	// Include the residuals of the unknown terms referenced by the residual expressions, and of
+	// the unknown terms referenced by those terms.
+	for added := true; added; {
+		added = false
+		for name := range refs.idents {
+			det, found := act.unknownTerm(name)
+			if _, seen := res.Terms[name]; !found || seen {
+				continue
+			}
+			res.Terms[name] = residualExpr(eval.termMap[name].ast, det, refs)
+			added = true
+		}
+	}
+	res.Attributes = refs.attributes(ev.unknowns)
+	ev.residuals = append(ev.residuals, res)
+	if unknownMatch {
+		return &valueProgram{val: match, det: matchDet}
+	}
+	return &valueProgram{val: out, det: outDet}
+}
+
+// valueProgram is a cel.Program which returns a precomputed result, such as an unknown value, the
+// value substituted for an evaluation error, or a decision output evaluated during partial
+// evaluation.
+type valueProgram struct {
+	val ref.Val
+	det *cel.EvalDetails
+	err error
+}
+
+// Eval implements the cel.Program interface method.
+func (prg *valueProgram) Eval(interface{}) (ref.Val, *cel.EvalDetails, error) {
+	return prg.val, prg.det, prg.err
+}
+
+// residualExpr prunes the known values from the expression using the evaluation state, records
+// the references within the pruned expression, and renders the pruned expression as text.
+func residualExpr(ast *cel.Ast, det *cel.EvalDetails, refs *residualRefs) string {
+	expr := ast.Expr()
+	if det != nil {
+		expr = interpreter.PruneAst(expr, det.State())
+	}
+	refs.collect(expr)
+	str, err := cel.AstToString(cel.ParsedExprToAst(&exprpb.ParsedExpr{Expr: expr}))
+	if err != nil {
+		return err.Error()
+	}
+	return str
+}
+
+// residualRefs collects the identifiers and qualified names referenced within residual
+// expressions.
+type residualRefs struct {
+	idents map[string]struct{}
+	chains map[string]struct{}
+}
+
+func (refs *residualRefs) collect(e *exprpb.Expr) {
+	if e == nil {
+		return
+	}
+	if name, ok := qualifiedName(e); ok {
+		refs.chains[name] = struct{}{}
+		refs.idents[strings.SplitN(name, ".", 2)[0]] = struct{}{}
+		return
+	}
+	switch k := e.ExprKind.(type) {
+	case *exprpb.Expr_SelectExpr:
+		refs.collect(k.SelectExpr.GetOperand())
+	case *exprpb.Expr_CallExpr:
+		refs.collect(k.CallExpr.GetTarget())
+		for _, arg := range k.CallExpr.GetArgs() {
+			refs.collect(arg)
+		}
+	case *exprpb.Expr_ListExpr:
+		for _, elem := range k.ListExpr.GetElements() {
+			refs.collect(elem)
+		}
+	case *exprpb.Expr_StructExpr:
+		for _, entry := range k.StructExpr.GetEntries() {
+			refs.collect(entry.GetMapKey())
+			refs.collect(entry.GetValue())
+		}
+	case *exprpb.Expr_ComprehensionExpr:
+		comp := k.ComprehensionExpr
+		refs.collect(comp.GetIterRange())
+		refs.collect(comp.GetAccuInit())
+		refs.collect(comp.GetLoopCondition())
+		refs.collect(comp.GetLoopStep())
+		refs.collect(comp.GetResult())
+	}
+}
+
+// attributes returns the sorted set of qualified names which match the unknown patterns.
+func (refs *residualRefs) attributes(unknowns []*interpreter.AttributePattern) []string {
+	attrs := []string{}
+	for chain := range refs.chains {
+		if matchesUnknown(chain, unknowns) {
+			attrs = append(attrs, chain)
+		}
+	}
+	sort.Strings(attrs)
+	return attrs
+}
+
+// matchesUnknown returns whether the qualified name, or one of its prefixes, refers to a variable
+// within the unknown patterns.
+func matchesUnknown(name string, unknowns []*interpreter.AttributePattern) bool {
+	elems := strings.Split(name, ".")
+	for i := len(elems); i > 0; i-- {
+		prefix := strings.Join(elems[:i], ".")
+		for _, pat := range unknowns {
+			if pat.VariableMatches(prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// qualifiedName returns the dot-qualified name of an identifier or field selection chain.
+func qualifiedName(e *exprpb.Expr) (string, bool) {
+	switch k := e.ExprKind.(type) {
+	case *exprpb.Expr_IdentExpr:
+		return k.IdentExpr.GetName(), true
+	case *exprpb.Expr_SelectExpr:
+		if k.SelectExpr.GetTestOnly() {
+			return "", false
+		}
+		op, ok := qualifiedName(k.SelectExpr.GetOperand())
+		if !ok {
+			return "", false
+		}
+		return op + "." + k.SelectExpr.GetField(), true
+	}
+	return "", false
+}
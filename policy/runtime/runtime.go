@@ -16,15 +16,18 @@
 package runtime
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"reflect"
+	"sort"
 	"sync"
 
 	"github.com/google/cel-policy-templates-go/policy/limits"
 	"github.com/google/cel-policy-templates-go/policy/model"
 
 	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker"
 	"github.com/google/cel-go/common"
 	"github.com/google/cel-go/common/types"
 	"github.com/google/cel-go/common/types/ref"
@@ -42,6 +45,8 @@ func NewTemplate(res model.Resolver,
 		res:          res,
 		mdl:          mdl,
 		decAggMap:    map[string]Aggregator{},
+		errDisps:     map[string]*ErrorDisposition{},
+		finScopes:    map[string]FinalizationScope{},
 		exprOpts:     []cel.ProgramOption{},
 		limits:       limits.NewLimits(),
 		actPool:      newRuleActivationPool(),
@@ -55,6 +60,16 @@ func NewTemplate(res model.Resolver,
 			return nil, err
 		}
 	}
+	for _, d := range mdl.Decisions {
+		t, err = t.declareAggregator(d)
+		if err != nil {
+			return nil, err
+		}
+		t, err = t.declareScope(d)
+		if err != nil {
+			return nil, err
+		}
+	}
 	if mdl.Validator != nil {
 		termCnt := len(mdl.Validator.Terms)
 		if termCnt > t.limits.ValidatorTermLimit {
@@ -96,29 +111,242 @@ func NewTemplate(res model.Resolver,
 	return t, nil
 }
 
+// declaredAggregators maps the aggregation strategies which may be declared within a template to
+// the options which configure the corresponding aggregator.
+var declaredAggregators = map[string]func(string) TemplateOption{
+	model.AggregateAnd:             NewAndAggregator,
+	model.AggregateOr:              NewOrAggregator,
+	model.AggregateCollect:         NewCollectAggregator,
+	model.AggregateCollectFirst:    NewCollectFirstAggregator,
+	model.AggregateFirstApplicable: NewFirstApplicableAggregator,
+	model.AggregateDenyOverrides:   NewDenyOverridesAggregator,
+	model.AggregatePermitOverrides: NewPermitOverridesAggregator,
+	model.AggregatePriority:        NewPriorityAggregator,
+	model.AggregateMin:             NewMinAggregator,
+	model.AggregateMax:             NewMaxAggregator,
+	model.AggregateSum:             NewSumAggregator,
+	model.AggregateCount:           NewCountAggregator,
+}
+
+// declareAggregator configures the aggregator for the aggregation strategy declared by the
+// template, and returns an error if a different aggregator was configured for the decision via
+// a TemplateOption.
+func (t *Template) declareAggregator(d *model.DecisionDecl) (*Template, error) {
+	newAgg, found := declaredAggregators[d.Aggregate]
+	if !found {
+		return nil, fmt.Errorf("decision %s: unsupported aggregation: %s", d.Name, d.Aggregate)
+	}
+	prev, configured := t.decAggMap[d.Name]
+	t, err := newAgg(d.Name)(t)
+	if err != nil {
+		return nil, err
+	}
+	if configured && !reflect.DeepEqual(prev, t.decAggMap[d.Name]) {
+		return nil, fmt.Errorf(
+			"decision %s: configured aggregator %T conflicts with declared aggregation: %s",
+			d.Name, prev, d.Aggregate)
+	}
+	return t, nil
+}
+
 // Template represents an evaluable version of a model.Template.
 type Template struct {
 	res       model.Resolver
 	mdl       *model.Template
 	limits    *limits.Limits
 	decAggMap map[string]Aggregator
+	errDisps  map[string]*ErrorDisposition
+	finScopes map[string]FinalizationScope
 	exprOpts  []cel.ProgramOption
+	partial   bool
 
 	validator    *evaluator
 	evaluator    *evaluator
 	actPool      *ruleActivationPool
 	valSlotPool  *decisionSlotPool
 	evalSlotPool *decisionSlotPool
+	// prepared maps instances to the values of their rule terms, indexed by rule and term slot.
+	prepared sync.Map
 }
 
 // Eval returns the evaluation result of a policy instance against a given set of variables.
 func (t *Template) Eval(inst *model.Instance,
 	vars interpreter.Activation,
 	selector model.DecisionSelector) ([]model.DecisionValue, error) {
+	return t.EvalContext(context.Background(), inst, vars, selector)
+}
+
+// EvalContext returns the evaluation result of a policy instance against a given set of
+// variables, stopping early if the context is cancelled or its deadline is exceeded.
+//
+// The context is checked before each rule, range iteration, and production is evaluated. When
+// evaluation stops early, the decisions which were finalized prior to the interruption are
+// returned along with the context error, either context.Canceled or context.DeadlineExceeded.
+//
+// Evaluation also stops early with a *CostLimitError when the cost of the evaluation exceeds the
+// EvaluationCostLimit of the template limits.
+func (t *Template) EvalContext(ctx context.Context,
+	inst *model.Instance,
+	vars interpreter.Activation,
+	selector model.DecisionSelector) ([]model.DecisionValue, error) {
+	ev := NewEvaluation(ctx, selector)
+	ev.SetCostLimit(t.limits.EvaluationCostLimit)
+	err := t.EvalInstance(ev, inst, vars)
+	if err != nil {
+		if ev.Err() != nil {
+			return ev.FinalDecisions(), err
+		}
+		return nil, err
+	}
+	return ev.Decisions(), nil
+}
+
+// EvalInstance evaluates a policy instance against a given set of variables and aggregates the
+// resulting decisions into the Evaluation.
+//
+// Decisions already present within the Evaluation are used as the starting point for aggregation
+// so that decisions combine across all of the templates and instances evaluated with the same
+// Evaluation. Productions which only contribute to finalized decisions are skipped.
+//
+// Terms which depend only on the input variables are shared across the instances evaluated with
+// the same Evaluation, so the variables must be the same for each instance.
+func (t *Template) EvalInstance(ev *Evaluation,
+	inst *model.Instance,
+	vars interpreter.Activation) error {
 	slots := t.evalSlotPool.Setup()
-	decs, err := t.evalInternal(t.evaluator, inst, vars, selector, slots)
+	ev.seedSlots(t.evaluator.slotNames, slots)
+	trace := ev.traceInstance(t.mdl, inst)
+	var ruleTerms [][]ref.Val
+	if prepared, found := t.prepared.Load(inst); found {
+		ruleTerms = prepared.([][]ref.Val)
+	}
+	err := t.evalInternal(ev, t.evaluator, inst, vars, ruleTerms, slots, trace)
+	ev.collectSlots(t.evaluator.slotNames, slots)
 	t.evalSlotPool.Put(slots)
-	return decs, err
+	return err
+}
+
+// PrepareInstance evaluates the terms of the template evaluator which depend only on the rules of
+// the instance, the template and instance metadata, and constants, and retains their values for
+// reuse by subsequent evaluations of the instance.
+//
+// The terms are evaluated within the given Evaluation, whose context and cost limit bound the
+// preparation, and whose cost reflects the cost of the terms evaluated. Preparation stops early
+// once the Evaluation is interrupted, and the cost of the prepared terms is not charged again when
+// the instance is evaluated.
+//
+// Terms which fail to evaluate are not retained and are instead evaluated and reported as usual
+// when the instance is evaluated. Functions within the evaluator environment are assumed to
+// produce the same result for the same arguments.
+func (t *Template) PrepareInstance(ev *Evaluation, inst *model.Instance) {
+	eval := t.evaluator
+	if eval == nil || len(eval.ruleTerms) == 0 {
+		return
+	}
+	rules := inst.Rules
+	if t.mdl.RuleTypes == nil {
+		rules = []model.Rule{nil}
+	}
+	if len(rules) > t.limits.RuleLimit {
+		return
+	}
+	ruleAct := t.actPool.Setup(noVars)
+	ruleAct.budget = ev.budget
+	ruleAct.unknowns = nil
+	ruleAct.tmpl = t.mdl
+	ruleAct.inst = inst
+	ruleAct.tmplMetadata = t.mdl.MetadataMap()
+	ruleAct.instMetadata = inst.MetadataMap()
+	ruleTerms := make([][]ref.Val, len(rules))
+	for i, rule := range rules {
+		ruleAct.rule = rule
+		act := eval.actPool.Setup(ruleAct)
+		vals := make([]ref.Val, len(eval.terms))
+		for _, term := range eval.ruleTerms {
+			if ev.Err() != nil {
+				break
+			}
+			val, _ := act.ResolveName(term.name)
+			if cval, ok := val.(ref.Val); ok && !types.IsUnknownOrError(cval) {
+				vals[term.slot] = cval
+			}
+		}
+		eval.actPool.Put(act)
+		ruleTerms[i] = vals
+	}
+	t.actPool.Put(ruleAct)
+	t.prepared.Store(inst, ruleTerms)
+}
+
+// ReleaseInstance discards the term values retained for the instance by PrepareInstance.
+func (t *Template) ReleaseInstance(inst *model.Instance) {
+	t.prepared.Delete(inst)
+}
+
+// IsPrepared returns whether term values are retained for the instance by PrepareInstance.
+func (t *Template) IsPrepared(inst *model.Instance) bool {
+	_, found := t.prepared.Load(inst)
+	return found
+}
+
+// MergeEvaluation merges the decisions aggregated within an Evaluation forked from the target
+// Evaluation into the target using the template's aggregators.
+//
+// The forked Evaluation is expected to contain the results of evaluating one or more instances of
+// the template. Merging forked evaluations in instance order produces the same decisions as if
+// the instances had been evaluated in order against the target Evaluation, which makes it
+// possible to evaluate instances concurrently.
+func (t *Template) MergeEvaluation(ev, forked *Evaluation) error {
+	if t.evaluator != nil {
+		// Merge the statically named decisions first, followed by the referenced decisions in the
+		// order they were produced, consistent with the ordering applied by collectSlots.
+		names := append([]string{}, t.evaluator.slotNames...)
+		for _, name := range forked.names {
+			if _, found := t.evaluator.slotMap[name]; !found {
+				names = append(names, name)
+			}
+		}
+		for _, name := range names {
+			next, found := forked.values[name]
+			if !found {
+				continue
+			}
+			prev, found := ev.values[name]
+			if !found {
+				ev.names = append(ev.names, name)
+				ev.values[name] = next
+				continue
+			}
+			dv, err := merge(name, t.evaluator.aggregator(name), prev, next)
+			if err != nil {
+				return err
+			}
+			ev.values[name] = dv
+		}
+	}
+	if ev.trace != nil && forked.trace != nil {
+		ev.trace.Instances = append(ev.trace.Instances, forked.trace.Instances...)
+	}
+	ev.residuals = append(ev.residuals, forked.residuals...)
+	return nil
+}
+
+// DecisionNames returns the names of the decisions which may be produced by the template
+// evaluator.
+//
+// The names of decisions produced via a decision reference are computed during evaluation and
+// are not included. Use HasDecisionReferences to determine whether the set of names is complete.
+func (t *Template) DecisionNames() []string {
+	if t.evaluator == nil {
+		return []string{}
+	}
+	return t.evaluator.slotNames
+}
+
+// HasDecisionReferences returns whether the template evaluator produces decisions whose names
+// are computed during evaluation.
+func (t *Template) HasDecisionReferences() bool {
+	return t.evaluator != nil && t.evaluator.hasRefs
 }
 
 // FindAggregator returns the Aggregator for the decision if one is found.
@@ -142,11 +370,13 @@ func (t *Template) Validate(src *model.Source, inst *model.Instance) *cel.Issues
 	slots := t.valSlotPool.Setup()
 	defer t.valSlotPool.Put(slots)
 
-	decs, err := t.evalInternal(t.validator, inst, noVars, nil, slots)
+	ev := NewEvaluation(context.Background(), nil)
+	err := t.evalInternal(ev, t.validator, inst, noVars, nil, slots, nil)
 	if err != nil {
 		errs.ReportError(common.NoLocation, err.Error())
 		return cel.NewIssues(errs)
 	}
+	decs := slotsToDecisions(slots)
 	if decs == nil || len(decs) == 0 {
 		return nil
 	}
@@ -202,46 +432,104 @@ func (t *Template) constructRulesMap(rules []model.Rule) map[int64]model.Rule {
 	return ruleMap
 }
 
-func (t *Template) evalInternal(eval *evaluator,
+// evalInternal evaluates the rules of the instance, using the rule term values prepared for the
+// instance, if any, in place of evaluating the terms.
+func (t *Template) evalInternal(ev *Evaluation,
+	eval *evaluator,
 	inst *model.Instance,
 	vars interpreter.Activation,
-	selector model.DecisionSelector,
-	slots *decisionSlots) ([]model.DecisionValue, error) {
+	ruleTerms [][]ref.Val,
+	slots *decisionSlots,
+	trace *InstanceTrace) error {
 	ruleAct := t.actPool.Setup(vars)
+	ruleAct.budget = ev.budget
+	ruleAct.terms = ev.terms
+	ruleAct.now = ev.now
+	ruleAct.unknowns = ev.unknowns
+	ruleAct.tmpl = t.mdl
+	ruleAct.inst = inst
 	ruleAct.tmplMetadata = t.mdl.MetadataMap()
 	ruleAct.instMetadata = inst.MetadataMap()
 
 	// Singleton policy without a schema.
 	if t.mdl.RuleTypes == nil {
-		err := eval.eval(nil, selector, ruleAct, slots)
-		t.actPool.Put(ruleAct)
-		if err != nil {
-			return nil, err
+		if len(ruleTerms) == 1 {
+			ruleAct.ruleTerms = ruleTerms[0]
 		}
-		return slotsToDecisions(slots), nil
+		err := eval.eval(ev, nil, ruleAct, slots, ruleAct.traceRule(trace, nil))
+		scopeErr := eval.closeScope(ev, ruleAct, slots, InstanceScope)
+		if scopeErr != nil && ev.Err() == nil {
+			var errs EvalErrors
+			if err != nil {
+				errs = errs.append(err)
+			}
+			err = errs.append(scopeErr)
+		}
+		t.actPool.Put(ruleAct)
+		return err
 	}
 	// One or more rules present in the policy.
 	if len(inst.Rules) > t.limits.RuleLimit {
-		return nil, fmt.Errorf(
+		err := ruleAct.evalError(nil, InstanceError, "", common.NoLocation, fmt.Errorf(
 			"rule limit set to %d, but %d found",
-			t.limits.RuleLimit, len(inst.Rules))
+			t.limits.RuleLimit, len(inst.Rules)))
+		t.actPool.Put(ruleAct)
+		return EvalErrors{err}
 	}
-	for _, rule := range inst.Rules {
-		err := eval.eval(rule, selector, ruleAct, slots)
-		if err != nil {
+	// Evaluate all of the rules, collecting the errors encountered along the way, unless the
+	// evaluation is interrupted. Decisions finalized per rule are merged as each rule completes,
+	// and those finalized per instance once all of the rules have been evaluated.
+	var errs EvalErrors
+	for i, rule := range inst.Rules {
+		if len(ruleTerms) == len(inst.Rules) {
+			ruleAct.ruleTerms = ruleTerms[i]
+		}
+		err := ev.Err()
+		if err == nil {
+			err = eval.eval(ev, rule, ruleAct, slots, ruleAct.traceRule(trace, rule))
+		}
+		if scopeErr := eval.closeScope(ev, ruleAct, slots, RuleScope); scopeErr != nil {
+			errs = errs.append(scopeErr)
+		}
+		if err == nil {
+			continue
+		}
+		if ctxErr := ev.Err(); ctxErr != nil {
 			t.actPool.Put(ruleAct)
-			return nil, err
+			return ctxErr
 		}
+		errs = errs.append(err)
+	}
+	if err := eval.closeScope(ev, ruleAct, slots, InstanceScope); err != nil {
+		errs = errs.append(err)
 	}
 	t.actPool.Put(ruleAct)
-	return slotsToDecisions(slots), nil
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
 }
 
 func (t *Template) newEvaluator(mdl *model.Evaluator,
 	exprCostLimit int,
 	evalOpts ...cel.ProgramOption) (*evaluator, error) {
-	terms := make(map[string]cel.Program, len(mdl.Terms))
+	terms := make([]*term, len(mdl.Terms))
+	termMap := make(map[string]*term, len(mdl.Terms))
+	termVars := mdl.TermVariables()
+	rangeVars := map[string]struct{}{}
+	for _, r := range mdl.Ranges {
+		if r.Key != nil {
+			rangeVars[r.Key.GetName()] = struct{}{}
+		}
+		if r.Value != nil {
+			rangeVars[r.Value.GetName()] = struct{}{}
+		}
+	}
+	var ruleTerms []*term
 	evalOpts = append(evalOpts, cel.EvalOptions(cel.OptOptimize))
+	if t.partial {
+		evalOpts = append(evalOpts, cel.EvalOptions(cel.OptPartialEval, cel.OptTrackState))
+	}
 	env, err := t.newEnv(mdl.Environment)
 	if err != nil {
 		return nil, err
@@ -267,6 +555,7 @@ func (t *Template) newEvaluator(mdl *model.Evaluator,
 			mr := &mapRange{
 				key: r.Key,
 				val: r.Value,
+				loc: exprLocation(r.Expr),
 				prg: rangePrg,
 			}
 			ranges[i] = mr
@@ -274,23 +563,38 @@ func (t *Template) newEvaluator(mdl *model.Evaluator,
 			lr := &listRange{
 				idx: r.Key,
 				val: r.Value,
+				loc: exprLocation(r.Expr),
 				prg: rangePrg,
 			}
 			ranges[i] = lr
 		}
 	}
-	for _, t := range mdl.Terms {
-		term, err := env.Program(t.Expr, evalOpts...)
+	for i, t := range mdl.Terms {
+		prg, err := env.Program(t.Expr, evalOpts...)
 		if err != nil {
 			return nil, err
 		}
-		terms[t.Name] = term
-		_, max := cel.EstimateCost(term)
+		terms[i] = &term{
+			name: t.Name,
+			slot: i,
+			kind: classifyTerm(termVars[t.Name], rangeVars),
+			ast:  t.Expr,
+			loc:  exprLocation(t.Expr),
+			prg:  prg,
+		}
+		termMap[t.Name] = terms[i]
+		if isRuleTerm(termVars[t.Name]) {
+			ruleTerms = append(ruleTerms, terms[i])
+		}
+		_, max := cel.EstimateCost(prg)
 		cost = addAndCap(cost, max)
 	}
 
 	prods := make([]*prod, len(mdl.Productions))
 	decSlotMap := make(map[string]int)
+	hasRefs := false
+	var slotNames []string
+	var slotAggs []Aggregator
 	nextSlot := 0
 	for i, p := range mdl.Productions {
 		match, err := env.Program(p.Match, evalOpts...)
@@ -313,24 +617,53 @@ func (t *Template) newEvaluator(mdl *model.Evaluator,
 			}
 			_, max := cel.EstimateCost(dec)
 			cost = addAndCap(cost, max)
+			if d.Reference != nil {
+				refPrg, err := env.Program(d.Reference, evalOpts...)
+				if err != nil {
+					return nil, err
+				}
+				_, max := cel.EstimateCost(refPrg)
+				cost = addAndCap(cost, max)
+				hasRefs = true
+				decs[i] = &decision{
+					slot:   -1,
+					ref:    refPrg,
+					refAst: d.Reference,
+					ast:    d.Output,
+					prg:    dec,
+				}
+				continue
+			}
+			agg, found := t.FindAggregator(d.Name)
+			if !found {
+				agg = &CollectAggregator{name: d.Name}
+			}
 			slot, found := decSlotMap[d.Name]
 			if !found {
 				slot = nextSlot
 				decSlotMap[d.Name] = nextSlot
+				slotNames = append(slotNames, d.Name)
+				slotAggs = append(slotAggs, agg)
 				nextSlot++
 			}
-			agg, found := t.FindAggregator(d.Name)
-			if !found {
-				agg = &CollectAggregator{name: d.Name}
-			}
 			decs[i] = &decision{
 				name: d.Name,
 				slot: slot,
+				ast:  d.Output,
 				prg:  dec,
 				agg:  agg,
 			}
 		}
+		var prodLoc common.Location = common.NoLocation
+		if t.mdl.Meta != nil {
+			if loc, found := t.mdl.Meta.LocationByID(p.ID); found {
+				prodLoc = loc
+			}
+		}
 		prods[i] = &prod{
+			id:        p.ID,
+			loc:       prodLoc,
+			matchAst:  p.Match,
 			match:     match,
 			decisions: decs,
 		}
@@ -341,17 +674,84 @@ func (t *Template) newEvaluator(mdl *model.Evaluator,
 			"evaluator expression cost limit set to %d, but %d found",
 			exprCostLimit, cost)
 	}
+	// The outputs of referenced decisions are checked against the declared decision types once
+	// the decision names are known.
+	declTypes := map[string]*model.DeclType{}
+	for _, d := range t.mdl.Decisions {
+		if hasRefs && d.Type != model.AnyType && d.Type != model.DynType {
+			declTypes[d.Name] = d.Type
+		}
+	}
 	eval := &evaluator{
-		mdl:     mdl,
-		env:     env,
-		ranges:  ranges,
-		terms:   terms,
-		prods:   prods,
-		actPool: newEvalActivationPool(terms),
+		mdl:       mdl,
+		env:       env,
+		ranges:    ranges,
+		terms:     terms,
+		termMap:   termMap,
+		ruleTerms: ruleTerms,
+		prods:     prods,
+		slotMap:   decSlotMap,
+		slotNames: slotNames,
+		slotAggs:  slotAggs,
+		decAggMap: t.decAggMap,
+		declTypes: declTypes,
+		errDisps:  t.errDisps,
+		finScopes: t.finScopes,
+		hasRefs:   hasRefs,
+		actPool:   newEvalActivationPool(terms, termMap),
 	}
 	return eval, nil
 }
 
+// term is a compiled evaluator term whose value is memoized within the evaluator activation at
+// the term's slot index.
+type term struct {
+	name string
+	slot int
+	kind termKind
+	ast  *cel.Ast
+	loc  common.Location
+	prg  cel.Program
+}
+
+// termKind classifies terms by the variables upon which their values depend.
+type termKind int
+
+const (
+	// inputTerm values depend only on the evaluation input and constants, and are shared across
+	// all of the instances and rules of the template evaluated on behalf of an Evaluation.
+	inputTerm termKind = iota
+	// ruleTerm values depend on the rule, template, or instance under evaluation.
+	ruleTerm
+	// rangeTerm values depend on the range variables of the current iteration.
+	rangeTerm
+)
+
+// classifyTerm returns the kind of a term referencing the given variables.
+func classifyTerm(vars, rangeVars map[string]struct{}) termKind {
+	kind := inputTerm
+	for v := range vars {
+		if _, found := rangeVars[v]; found {
+			return rangeTerm
+		}
+		if v == "rule" || v == "template" || v == "instance" {
+			kind = ruleTerm
+		}
+	}
+	return kind
+}
+
+// isRuleTerm returns whether a term referencing the given variables evaluates to the same value
+// for every evaluation of a given rule.
+func isRuleTerm(vars map[string]struct{}) bool {
+	for v := range vars {
+		if v != "rule" && v != "template" && v != "instance" {
+			return false
+		}
+	}
+	return true
+}
+
 // addAndCap returns the max int64 if the cost overflows after the addition.
 func addAndCap(cost, addend int64) int64 {
 	result := cost + addend
@@ -385,90 +785,307 @@ func (t *Template) newEnv(name string) (*cel.Env, error) {
 }
 
 type evaluator struct {
-	mdl    *model.Evaluator
-	env    *cel.Env
-	ranges []iterable
-	// TODO: change this to an array and rewrite terms to be register functions
-	terms   map[string]cel.Program
-	prods   []*prod
-	actPool *evalActivationPool
+	mdl       *model.Evaluator
+	env       *cel.Env
+	ranges    []iterable
+	terms     []*term
+	termMap   map[string]*term
+	ruleTerms []*term
+	prods     []*prod
+	slotMap   map[string]int
+	slotNames []string
+	slotAggs  []Aggregator
+	decAggMap map[string]Aggregator
+	declTypes map[string]*model.DeclType
+	errDisps  map[string]*ErrorDisposition
+	finScopes map[string]FinalizationScope
+	hasRefs   bool
+	actPool   *evalActivationPool
 }
 
-func (eval *evaluator) eval(rule model.Rule,
-	selector model.DecisionSelector,
+// aggregator returns the Aggregator for the decision name, defaulting to a CollectAggregator for
+// referenced decisions without a configured aggregator.
+func (eval *evaluator) aggregator(name string) Aggregator {
+	if slot, found := eval.slotMap[name]; found {
+		return eval.slotAggs[slot]
+	}
+	if agg, found := eval.decAggMap[name]; found {
+		return agg
+	}
+	return &CollectAggregator{name: name}
+}
+
+// resolveDecision returns the name and slot of the decision, evaluating the decision reference
+// if present. Referenced names which match a statically named decision share its slot, otherwise
+// the slot is -1 and the value is tracked by name within the decision slots.
+func (eval *evaluator) resolveDecision(p *prod,
+	d *decision,
+	act *evaluatorActivation) (string, int, EvalErrors) {
+	if d.ref == nil {
+		return d.name, d.slot, nil
+	}
+	val, _, err := d.ref.Eval(act)
+	if err == nil {
+		if _, ok := val.(types.String); !ok {
+			err = fmt.Errorf("decision reference must evaluate to a string, found: %v", val)
+		}
+	}
+	if err != nil {
+		errs := eval.termErrors(act, d.refAst)
+		return "", -1, append(errs,
+			act.input.evalError(p, DecisionRefError, "", exprLocation(d.refAst), err))
+	}
+	name := val.(types.String)
+	if slot, found := eval.slotMap[string(name)]; found {
+		return string(name), slot, nil
+	}
+	return string(name), -1, nil
+}
+
+// checkedOutput returns a program which checks that the output of a referenced decision conforms
+// to the type declared for the decision, as the output type cannot be checked when the template
+// is compiled.
+func (eval *evaluator) checkedOutput(prg cel.Program, d *decision, name string) cel.Program {
+	if d.ref == nil {
+		return prg
+	}
+	declType, found := eval.declTypes[name]
+	if !found {
+		return prg
+	}
+	return &typeCheckedProgram{Program: prg, name: name, declType: declType}
+}
+
+// typeCheckedProgram returns an error when the output of the wrapped program does not conform to
+// the declared decision type.
+type typeCheckedProgram struct {
+	cel.Program
+	name     string
+	declType *model.DeclType
+}
+
+// Eval implements the cel.Program interface method.
+func (prg *typeCheckedProgram) Eval(vars interface{}) (ref.Val, *cel.EvalDetails, error) {
+	val, det, err := prg.Program.Eval(vars)
+	if err != nil || conformsToType(val, prg.declType) {
+		return val, det, err
+	}
+	return nil, det, fmt.Errorf("expected %s output for decision %s, found: %s",
+		checker.FormatCheckedType(prg.declType.ExprType()), prg.name, formatVal(val))
+}
+
+// conformsToType returns whether the value is assignable to the declared type. Unknown values
+// conform to every type, as do all values when the declared type is 'any' or 'dyn'.
+func conformsToType(val ref.Val, t *model.DeclType) bool {
+	if types.IsUnknown(val) || t == model.AnyType || t == model.DynType {
+		return true
+	}
+	switch {
+	case t.IsObject():
+		obj, ok := val.(traits.Mapper)
+		if !ok {
+			return val.Type().TypeName() == t.TypeName()
+		}
+		found := 0
+		for _, f := range t.Fields {
+			fv, hasField := obj.Find(types.String(f.Name))
+			if !hasField {
+				if f.Required {
+					return false
+				}
+				continue
+			}
+			found++
+			if !conformsToType(fv, f.Type) {
+				return false
+			}
+		}
+		// Fields which are not declared do not conform to the object type.
+		return obj.Size() == types.Int(found)
+	case t.IsList():
+		l, ok := val.(traits.Lister)
+		if !ok {
+			return false
+		}
+		for it := l.Iterator(); it.HasNext() == types.True; {
+			if !conformsToType(it.Next(), t.ElemType) {
+				return false
+			}
+		}
+		return true
+	case t.IsMap():
+		m, ok := val.(traits.Mapper)
+		if !ok {
+			return false
+		}
+		for it := m.Iterator(); it.HasNext() == types.True; {
+			key := it.Next()
+			if !conformsToType(key, t.KeyType) || !conformsToType(m.Get(key), t.ElemType) {
+				return false
+			}
+		}
+		return true
+	}
+	return val.Type().TypeName() == checker.FormatCheckedType(t.ExprType())
+}
+
+func (eval *evaluator) eval(ev *Evaluation,
+	rule model.Rule,
 	vars *ruleActivation,
-	slots *decisionSlots) error {
+	slots *decisionSlots,
+	trace *RuleTrace) error {
 	vars.rule = rule
 	// Fast-path evaluation without ranges.
 	if len(eval.ranges) == 0 {
 		act := eval.actPool.Setup(vars)
-		err := eval.evalProductions(rule, selector, act, slots)
+		it := trace.traceIteration(nil)
+		err := eval.evalProductions(ev, vars, act, slots, it)
+		it.traceTerms(act)
 		eval.actPool.Put(act)
 		return err
 	}
 	// Range-based evaluation.
-	var errs []error
+	var errs EvalErrors
 	rangeIt := eval.rangeIterator(vars)
 	err := rangeIt.init(vars)
 	if err != nil {
-		return err
+		return eval.recoverRangeError(ev, vars, slots, err)
 	}
 	for rangeIt.hasNext() {
+		if err := ev.Err(); err != nil {
+			return err
+		}
+		if err := ev.budget.charge(1); err != nil {
+			return err
+		}
 		rangeIt.next(vars)
 		act := eval.actPool.Setup(vars)
-		err := eval.evalProductions(rule, selector, act, slots)
+		it := trace.traceIteration(vars.rangeVars)
+		err := eval.evalProductions(ev, vars, act, slots, it)
+		it.traceTerms(act)
+		eval.actPool.Put(act)
 		if err != nil {
-			errs = append(errs, err)
-			continue
+			if ctxErr := ev.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			errs = errs.append(err)
 		}
-		eval.actPool.Put(act)
 	}
 	if len(errs) > 0 {
-		return errs[0]
+		return errs
 	}
 	return nil
 }
 
-func (eval *evaluator) evalProductions(rule model.Rule,
-	selector model.DecisionSelector,
-	act interpreter.Activation,
-	slots *decisionSlots) error {
-	var errs []error
+func (eval *evaluator) evalProductions(ev *Evaluation,
+	vars *ruleActivation,
+	act *evaluatorActivation,
+	slots *decisionSlots,
+	trace *IterationTrace) error {
+	selector := ev.selector
+	var errs EvalErrors
 	for _, p := range eval.prods {
-		// TODO: update this to support finalization on a per-rule basis
-		// as this will support fine-tuning of the aggregation as a per-rule,
-		// per-policy, or per-policy set.
-		if !p.hasMoreDecisions(slots, selector) {
+		if err := ev.Err(); err != nil {
+			return err
+		}
+		pt := trace.traceProduction(p)
+		if !eval.hasMoreDecisions(ev, p, slots) {
+			if pt != nil {
+				pt.Skipped = true
+			}
 			continue
 		}
-		matches, _, err := p.match.Eval(act)
+		if err := ev.budget.charge(1); err != nil {
+			return err
+		}
+		matches, matchDet, err := p.match.Eval(act)
+		if pt != nil {
+			pt.Match = matches
+			pt.Err = err
+		}
 		if err != nil {
-			errs = append(errs, err)
+			if intErr := ev.Err(); intErr != nil {
+				return intErr
+			}
+			recovered, recErr := eval.recoverMatchError(ev, p, vars, act, slots)
+			if recErr != nil {
+				errs = errs.append(recErr)
+			}
+			if !recovered {
+				errs = append(errs, eval.termErrors(act, p.matchAst)...)
+				errs = append(errs, vars.evalError(p, MatchError, "", p.loc, err))
+			}
 			continue
 		}
-		if matches != types.True {
+		partial := len(ev.unknowns) != 0
+		if matches != types.True && !(partial && types.IsUnknown(matches)) {
 			continue
 		}
+		src := vars.decisionSource(p)
 		for _, d := range p.decisions {
-			if selector != nil && !selector(d.name) {
+			if d.ref != nil {
+				if err := ev.budget.charge(1); err != nil {
+					return err
+				}
+			}
+			name, slot, refErrs := eval.resolveDecision(p, d, act)
+			if refErrs != nil {
+				errs = append(errs, refErrs...)
+				continue
+			}
+			if selector != nil && !selector(name) {
+				continue
+			}
+			// Referenced decisions are only known once the name has been computed, so the
+			// finalization check is deferred until now.
+			if eval.isFinal(ev, slots, name, slot) {
 				continue
 			}
+			agg := d.agg
+			if d.ref != nil {
+				agg = eval.aggregator(name)
+			}
+			dt := pt.traceDecision(name)
+			out := d.prg
+			if partial {
+				// When either the match or the output depend on unknown attributes, record the
+				// residual and aggregate the unknown value into the decision.
+				out = eval.residual(ev, p, d, name, src, act, matches, matchDet)
+			}
+			out = eval.checkedOutput(out, d, name)
+			out = dt.traceOutput(out)
+			if err := ev.budget.charge(1); err != nil {
+				return err
+			}
 			// initialize the slot
-			dv := slots.values[d.slot]
+			dv := eval.current(ev, slots, name, slot)
 			if dv == nil {
-				dv = d.agg.DefaultDecision()
+				dv = agg.DefaultDecision()
 			}
-			dv, err = d.agg.Aggregate(d.prg, act, dv, rule)
+			dv, err = aggregate(agg, out, act, dv, src)
 			if err != nil {
-				errs = append(errs, err)
+				if dt != nil {
+					dt.Err = err
+				}
+				if intErr := ev.Err(); intErr != nil {
+					return intErr
+				}
+				recovered, recErr := eval.recoverError(ev, name, slot, act, slots, src)
+				if recovered {
+					continue
+				}
+				if recErr != nil {
+					err = recErr
+				}
+				errs = append(errs, eval.termErrors(act, d.ast)...)
+				errs = append(errs, vars.evalError(p, OutputError, name, exprLocation(d.ast), err))
 			} else {
-				slots.values[d.slot] = dv
+				eval.update(slots, name, slot, dv)
 			}
 		}
 	}
 	if len(errs) != 0 {
-		// TODO: report a better multi-error
-		return errs[0]
+		return errs
 	}
 	return nil
 }
@@ -571,6 +1188,7 @@ type rangeIterator interface {
 type mapRange struct {
 	key *exprpb.Decl
 	val *exprpb.Decl
+	loc common.Location
 	prg cel.Program
 }
 
@@ -583,15 +1201,17 @@ func (mr *mapRange) iter(vars *ruleActivation) rangeIterator {
 type mapIterator struct {
 	*mapRange
 	mapVal traits.Mapper
-	mapIt  traits.Iterator
+	keys   []ref.Val
+	idx    int
 }
 
 func (it *mapIterator) hasNext() bool {
-	return it.mapIt.HasNext() == types.True
+	return it.idx < len(it.keys)
 }
 
 func (it *mapIterator) next(vars *ruleActivation) error {
-	key := it.mapIt.Next()
+	key := it.keys[it.idx]
+	it.idx++
 	if it.mapRange.key != nil {
 		vars.rangeVars[it.mapRange.key.GetName()] = key
 	}
@@ -601,23 +1221,79 @@ func (it *mapIterator) next(vars *ruleActivation) error {
 	return nil
 }
 
+// reset evaluates the range expression and collects the map keys in the order given by keyLess,
+// so that map ranges are iterated deterministically.
 func (it *mapIterator) reset(vars *ruleActivation) error {
 	val, _, err := it.mapRange.prg.Eval(vars)
 	if err != nil {
-		return err
+		return vars.evalError(nil, RangeError, "", it.mapRange.loc, err)
 	}
 	mapVal, ok := val.(traits.Mapper)
 	if !ok {
-		return fmt.Errorf("iterator reset failed: got %T, wanted map", val)
+		return vars.evalError(nil, RangeError, "", it.mapRange.loc,
+			fmt.Errorf("iterator reset failed: got %T, wanted map", val))
+	}
+	keys := it.keys[:0]
+	mapIt := mapVal.Iterator()
+	for mapIt.HasNext() == types.True {
+		keys = append(keys, mapIt.Next())
 	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keyLess(keys[i], keys[j])
+	})
 	it.mapVal = mapVal
-	it.mapIt = mapVal.Iterator().(traits.Iterator)
+	it.keys = keys
+	it.idx = 0
 	return nil
 }
 
+// keyLess orders map keys first by type and then by value, so that the keys of dynamically typed
+// maps which mix key types are also ordered deterministically.
+//
+// Keys are ranked bool, int, uint, double, string, and bytes, followed by any other types in order
+// of their type names. Keys of the same type are ordered by comparison when supported, and by
+// their formatted values otherwise.
+func keyLess(a, b ref.Val) bool {
+	ra, rb := keyRank(a), keyRank(b)
+	if ra != rb {
+		return ra < rb
+	}
+	aType, bType := a.Type().TypeName(), b.Type().TypeName()
+	if aType != bType {
+		return aType < bType
+	}
+	if cmp, ok := a.(traits.Comparer); ok {
+		if out, ok := cmp.Compare(b).(types.Int); ok {
+			return out < 0
+		}
+	}
+	return fmt.Sprint(a.Value()) < fmt.Sprint(b.Value())
+}
+
+// keyRank returns the rank of the map key type within the ordering defined by keyLess.
+func keyRank(key ref.Val) int {
+	switch key.(type) {
+	case types.Bool:
+		return 0
+	case types.Int:
+		return 1
+	case types.Uint:
+		return 2
+	case types.Double:
+		return 3
+	case types.String:
+		return 4
+	case types.Bytes:
+		return 5
+	default:
+		return 6
+	}
+}
+
 type listRange struct {
 	idx *exprpb.Decl
 	val *exprpb.Decl
+	loc common.Location
 	prg cel.Program
 }
 
@@ -653,11 +1329,12 @@ func (it *listIterator) reset(vars *ruleActivation) error {
 	// Errors are packaged up into the 'val' element.
 	val, _, err := it.listRange.prg.Eval(vars)
 	if err != nil {
-		return err
+		return vars.evalError(nil, RangeError, "", it.listRange.loc, err)
 	}
 	listVal, ok := val.(traits.Lister)
 	if !ok {
-		return fmt.Errorf("reset iterator failed: got %T, wanted list", val)
+		return vars.evalError(nil, RangeError, "", it.listRange.loc,
+			fmt.Errorf("reset iterator failed: got %T, wanted list", val))
 	}
 	it.listVal = listVal
 	it.idx = types.Int(0)
@@ -666,42 +1343,82 @@ func (it *listIterator) reset(vars *ruleActivation) error {
 }
 
 type prod struct {
+	id        int64
+	loc       common.Location
+	matchAst  *cel.Ast
 	match     cel.Program
 	decisions []*decision
-	// TODO: support references. When references are present, they need to be accumulated
-	// separately from the decisions since the referenced name may be derived from the instance.
 }
 
-func (p *prod) hasMoreDecisions(slots *decisionSlots,
-	selector model.DecisionSelector) bool {
+// hasMoreDecisions returns whether the production contributes to any selected decision which has
+// not been finalized within its finalization scope.
+func (eval *evaluator) hasMoreDecisions(ev *Evaluation, p *prod, slots *decisionSlots) bool {
 	for _, d := range p.decisions {
 		if d == nil {
 			continue
 		}
-		if selector != nil && !selector(d.name) {
+		// The names of referenced decisions are not known until the production is evaluated.
+		if d.ref != nil {
+			return true
+		}
+		if !ev.Selects(d.name) {
 			continue
 		}
-		if !d.isFinal(slots) {
+		if !eval.isFinal(ev, slots, d.name, d.slot) {
 			return true
 		}
 	}
 	return false
 }
 
+// decision describes an output emitted by a production. Decisions are either statically named,
+// in which case they are aggregated into a fixed slot, or computed from a reference expression,
+// in which case the name, slot, and aggregator are resolved during evaluation.
 type decision struct {
-	name string
-	slot int
-	prg  cel.Program
-	agg  Aggregator
-}
-
-func (d *decision) isFinal(slots *decisionSlots) bool {
-	dv := slots.values[d.slot]
-	return dv != nil && dv.IsFinal()
+	name   string
+	slot   int
+	ref    cel.Program
+	refAst *cel.Ast
+	ast    *cel.Ast
+	prg    cel.Program
+	agg    Aggregator
 }
 
 type decisionSlots struct {
 	values []model.DecisionValue
+	// refNames and refValues record the referenced decisions which do not correspond to a
+	// statically named slot, in the order in which they were first produced.
+	refNames  []string
+	refValues map[string]model.DecisionValue
+	// scopedNames and scoped record the values aggregated within the current rule or instance
+	// for decisions with a narrower finalization scope than the policy set.
+	scopedNames []string
+	scoped      map[string]model.DecisionValue
+}
+
+// get returns the value of the decision slot, or the referenced decision by name when the slot is
+// negative. Referenced decisions are seeded from the Evaluation on first use.
+func (slots *decisionSlots) get(ev *Evaluation, name string, slot int) model.DecisionValue {
+	if slot >= 0 {
+		return slots.values[slot]
+	}
+	if dv, found := slots.refValues[name]; found {
+		return dv
+	}
+	return ev.values[name]
+}
+
+// set records the value of the decision slot, or the referenced decision by name when the slot
+// is negative.
+func (slots *decisionSlots) set(name string, slot int, dv model.DecisionValue) {
+	if slot >= 0 {
+		slots.values[slot] = dv
+		return
+	}
+	if _, found := slots.refValues[name]; !found {
+		slots.refNames = append(slots.refNames, name)
+	}
+	slots.refValues[name] = dv
 }
 
 func slotsToDecisions(slots *decisionSlots) []model.DecisionValue {
@@ -711,6 +1428,9 @@ func slotsToDecisions(slots *decisionSlots) []model.DecisionValue {
 			decisions = append(decisions, dv)
 		}
 	}
+	for _, name := range slots.refNames {
+		decisions = append(decisions, slots.refValues[name])
+	}
 	return decisions
 }
 
@@ -719,7 +1439,9 @@ func newDecisionSlotPool(size int) *decisionSlotPool {
 		Pool: &sync.Pool{
 			New: func() interface{} {
 				return &decisionSlots{
-					values: make([]model.DecisionValue, size),
+					values:    make([]model.DecisionValue, size),
+					refValues: map[string]model.DecisionValue{},
+					scoped:    map[string]model.DecisionValue{},
 				}
 			},
 		},
@@ -735,17 +1457,67 @@ func (pool *decisionSlotPool) Setup() *decisionSlots {
 	for i := range slots.values {
 		slots.values[i] = nil
 	}
+	for _, name := range slots.refNames {
+		delete(slots.refValues, name)
+	}
+	slots.refNames = slots.refNames[:0]
+	for _, name := range slots.scopedNames {
+		delete(slots.scoped, name)
+	}
+	slots.scopedNames = slots.scopedNames[:0]
 	return slots
 }
 
 type ruleActivation struct {
 	input        interpreter.Activation
+	budget       *costBudget
+	terms        *termCache
+	ruleTerms    []ref.Val
+	now          ref.Val
+	unknowns     []*interpreter.AttributePattern
 	rangeVars    map[string]ref.Val
 	rule         model.Rule
+	tmpl         *model.Template
+	inst         *model.Instance
 	tmplMetadata map[string]interface{}
 	instMetadata map[string]interface{}
 }
 
+// decisionSource describes the template, instance, and rule under evaluation along with the
+// production whose decisions are being emitted.
+//
+// The production may be nil when the source describes a term or range rather than a production.
+func (ctx *ruleActivation) decisionSource(p *prod) *model.DecisionSource {
+	src := &model.DecisionSource{
+		Template:           ctx.tmpl.Metadata.Name,
+		Rule:               ctx.rule,
+		ProductionLocation: common.NoLocation,
+	}
+	if p != nil {
+		src.ProductionID = p.id
+		src.ProductionLocation = p.loc
+	}
+	if ctx.inst.Metadata != nil {
+		src.InstanceNamespace = ctx.inst.Metadata.Namespace
+		src.InstanceName = ctx.inst.Metadata.Name
+	}
+	if info, ok := ctx.inst.Meta.(*model.SourceInfo); ok {
+		src.InstanceSource = info.Description
+	}
+	src.RuleLocation = ctx.ruleLocation(ctx.rule)
+	return src
+}
+
+// ruleLocation returns the source location of the rule within the instance, if known.
+func (ctx *ruleActivation) ruleLocation(rule model.Rule) common.Location {
+	if rule != nil && ctx.inst.Meta != nil {
+		if loc, found := ctx.inst.Meta.LocationByID(rule.GetID()); found {
+			return loc
+		}
+	}
+	return common.NoLocation
+}
+
 func (ctx *ruleActivation) ResolveName(name string) (interface{}, bool) {
 	if name == "rule" {
 		return ctx.rule, true
@@ -756,6 +1528,9 @@ func (ctx *ruleActivation) ResolveName(name string) (interface{}, bool) {
 	if name == "instance" {
 		return ctx.instMetadata, true
 	}
+	if name == "now" && ctx.now != nil {
+		return ctx.now, true
+	}
 	if ctx.rangeVars != nil {
 		val, found := ctx.rangeVars[name]
 		if found {
@@ -769,6 +1544,11 @@ func (ctx *ruleActivation) Parent() interpreter.Activation {
 	return ctx.input
 }
 
+// UnknownAttributePatterns implements the interpreter.PartialActivation interface method.
+func (ctx *ruleActivation) UnknownAttributePatterns() []*interpreter.AttributePattern {
+	return ctx.unknowns
+}
+
 func newRuleActivationPool() *ruleActivationPool {
 	return &ruleActivationPool{
 		Pool: sync.Pool{
@@ -788,13 +1568,27 @@ type ruleActivationPool struct {
 func (pool *ruleActivationPool) Setup(vars interpreter.Activation) *ruleActivation {
 	act := pool.Get().(*ruleActivation)
 	act.input = vars
+	act.budget = nil
+	act.terms = nil
+	act.ruleTerms = nil
+	act.now = nil
 	return act
 }
 
 type evaluatorActivation struct {
-	input     interpreter.Activation
-	terms     map[string]cel.Program
-	memoTerms map[string]ref.Val
+	input   *ruleActivation
+	terms   []*term
+	termMap map[string]*term
+	// termVals holds the memoized term values indexed by term slot, where a nil value indicates
+	// the term has not yet been evaluated.
+	termVals []ref.Val
+	// unkTerms records the evaluation details of terms whose values are unknown, by term slot.
+	unkTerms []*cel.EvalDetails
+	// termErrs records the errors of terms which failed to evaluate and which have not yet been
+	// reported alongside a failing expression, by term slot.
+	termErrs []*EvalError
+	// termErrCnt is the number of term errors which have not yet been reported.
+	termErrCnt int
 }
 
 // ResolveName implements the interpreter.Activation interface for CEL.
@@ -811,33 +1605,91 @@ func (ctx *evaluatorActivation) ResolveName(name string) (interface{}, bool) {
 	if found {
 		return val, true
 	}
-	val, found = ctx.memoTerms[name]
-	if found {
-		return val, true
-	}
-	term, found := ctx.terms[name]
+	t, found := ctx.termMap[name]
 	if !found {
 		return nil, false
 	}
-	cval, _, err := term.Eval(ctx)
-	if err != nil {
+	if memo := ctx.termVals[t.slot]; memo != nil {
+		return memo, true
+	}
+	if ctx.input.ruleTerms != nil {
+		if prepared := ctx.input.ruleTerms[t.slot]; prepared != nil {
+			ctx.termVals[t.slot] = prepared
+			return prepared, true
+		}
+	}
+	shared := t.kind == inputTerm
+	if shared {
+		if val, found := ctx.input.terms.load(t); found {
+			ctx.termVals[t.slot] = val
+			return val, true
+		}
+	}
+	// Once the cost limit is exceeded, the term resolves to an error without being evaluated or
+	// memoized, and the interruption is reported by the caller.
+	if err := ctx.input.budget.charge(1); err != nil {
 		return types.NewErr("%s", err), true
 	}
-	ctx.memoTerms[name] = cval
+	cval, det, err := t.prg.Eval(ctx)
+	if err != nil {
+		// Memoize the failure so the term is evaluated and reported at most once per pass.
+		cval = types.NewErr("%s", err)
+		ctx.termVals[t.slot] = cval
+		ctx.termErrs[t.slot] = ctx.input.evalError(nil, TermError, name, t.loc, err)
+		ctx.termErrCnt++
+		return cval, true
+	}
+	ctx.termVals[t.slot] = cval
+	if types.IsUnknown(cval) {
+		// Unknown values are not shared as the residuals of each instance require the details.
+		if det != nil {
+			ctx.unkTerms[t.slot] = det
+		}
+	} else if shared {
+		ctx.input.terms.store(t, cval)
+	}
 	return cval, true
 }
 
+// memoizedTerms returns the term values memoized during the evaluation pass by term name.
+func (ctx *evaluatorActivation) memoizedTerms() map[string]ref.Val {
+	vals := make(map[string]ref.Val, len(ctx.terms))
+	for _, t := range ctx.terms {
+		if val := ctx.termVals[t.slot]; val != nil {
+			vals[t.name] = val
+		}
+	}
+	return vals
+}
+
+// unknownTerm returns the evaluation details of the named term when its value is unknown.
+func (ctx *evaluatorActivation) unknownTerm(name string) (*cel.EvalDetails, bool) {
+	t, found := ctx.termMap[name]
+	if !found || ctx.unkTerms[t.slot] == nil {
+		return nil, false
+	}
+	return ctx.unkTerms[t.slot], true
+}
+
 func (ctx *evaluatorActivation) Parent() interpreter.Activation {
 	return nil
 }
 
-func newEvalActivationPool(terms map[string]cel.Program) *evalActivationPool {
+// UnknownAttributePatterns implements the interpreter.PartialActivation interface method.
+func (ctx *evaluatorActivation) UnknownAttributePatterns() []*interpreter.AttributePattern {
+	return ctx.input.unknowns
+}
+
+func newEvalActivationPool(terms []*term, termMap map[string]*term) *evalActivationPool {
 	return &evalActivationPool{
 		Pool: sync.Pool{
 			New: func() interface{} {
 				return &evaluatorActivation{
-					terms:     terms,
-					memoTerms: make(map[string]ref.Val, len(terms)),
+					terms:    terms,
+					termMap:  termMap,
+					termVals: make([]ref.Val, len(terms)),
+					unkTerms: make([]*cel.EvalDetails, len(terms)),
+					termErrs: make([]*EvalError, len(terms)),
 				}
 			},
 		},
@@ -848,12 +1700,15 @@ type evalActivationPool struct {
 	sync.Pool
 }
 
-func (pool *evalActivationPool) Setup(vars interpreter.Activation) *evaluatorActivation {
+func (pool *evalActivationPool) Setup(vars *ruleActivation) *evaluatorActivation {
 	act := pool.Get().(*evaluatorActivation)
 	act.input = vars
-	for k := range act.memoTerms {
-		delete(act.memoTerms, k)
+	for i := range act.termVals {
+		act.termVals[i] = nil
+		act.unkTerms[i] = nil
+		act.termErrs[i] = nil
 	}
+	act.termErrCnt = 0
 	return act
 }
 
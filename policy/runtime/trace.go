@@ -0,0 +1,298 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/cel-policy-templates-go/policy/model"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
+)
+
+// Trace records the steps taken while evaluating a set of policy instances in order to explain
+// how the resulting decisions were produced.
+//
+// A Trace is only recorded when requested via Evaluation.EnableTrace as recording the trace
+// copies the range bindings and term values computed for every rule.
+type Trace struct {
+	Instances []*InstanceTrace
+}
+
+// String renders the trace as human-readable text.
+func (tr *Trace) String() string {
+	var buf strings.Builder
+	for _, inst := range tr.Instances {
+		inst.write(&buf)
+	}
+	return buf.String()
+}
+
+// InstanceTrace records the evaluation of the rules within a single policy instance.
+type InstanceTrace struct {
+	Template          string
+	InstanceNamespace string
+	InstanceName      string
+	InstanceSource    string
+	Rules             []*RuleTrace
+}
+
+func (it *InstanceTrace) write(buf *strings.Builder) {
+	buf.WriteString("instance ")
+	buf.WriteString(it.Template)
+	buf.WriteString("/")
+	if it.InstanceNamespace != "" {
+		buf.WriteString(it.InstanceNamespace)
+		buf.WriteString("/")
+	}
+	buf.WriteString(it.InstanceName)
+	if it.InstanceSource != "" {
+		buf.WriteString(fmt.Sprintf(" (%s)", it.InstanceSource))
+	}
+	buf.WriteString("\n")
+	for _, r := range it.Rules {
+		r.write(buf)
+	}
+}
+
+// RuleTrace records the evaluation of a single rule, once per combination of range values.
+//
+// Singleton templates without rules are recorded as a single RuleTrace with a nil Rule.
+type RuleTrace struct {
+	Rule         model.Rule
+	RuleLocation common.Location
+	Iterations   []*IterationTrace
+}
+
+// RuleID returns the id of the traced rule, or zero if the template has no rules.
+func (rt *RuleTrace) RuleID() int64 {
+	if rt.Rule == nil {
+		return 0
+	}
+	return rt.Rule.GetID()
+}
+
+func (rt *RuleTrace) write(buf *strings.Builder) {
+	buf.WriteString(fmt.Sprintf("  rule[%d]", rt.RuleID()))
+	writeLocation(buf, rt.RuleLocation)
+	buf.WriteString("\n")
+	for _, it := range rt.Iterations {
+		it.write(buf)
+	}
+}
+
+// IterationTrace records the range bindings for a single evaluation pass over the evaluator
+// productions along with the term values computed during the pass.
+//
+// Terms are computed lazily, so only the terms referenced by the evaluated expressions appear
+// within the Terms map.
+type IterationTrace struct {
+	Bindings    map[string]ref.Val
+	Terms       map[string]ref.Val
+	Productions []*ProductionTrace
+}
+
+func (it *IterationTrace) write(buf *strings.Builder) {
+	for _, name := range sortedNames(it.Bindings) {
+		buf.WriteString(fmt.Sprintf("    range %s = %s\n", name, formatVal(it.Bindings[name])))
+	}
+	for _, name := range sortedNames(it.Terms) {
+		buf.WriteString(fmt.Sprintf("    term %s = %s\n", name, formatVal(it.Terms[name])))
+	}
+	for _, p := range it.Productions {
+		p.write(buf)
+	}
+}
+
+// ProductionTrace records the outcome of a single production within an evaluation pass.
+//
+// When all of the decisions emitted by the production were already final, or were not selected,
+// the production is Skipped and its match expression is not evaluated.
+type ProductionTrace struct {
+	ID        int64
+	Location  common.Location
+	Skipped   bool
+	Match     ref.Val
+	Err       error
+	Decisions []*DecisionTrace
+}
+
+func (pt *ProductionTrace) write(buf *strings.Builder) {
+	buf.WriteString(fmt.Sprintf("    production[%d]", pt.ID))
+	writeLocation(buf, pt.Location)
+	switch {
+	case pt.Skipped:
+		buf.WriteString(" skipped\n")
+	case pt.Err != nil:
+		buf.WriteString(fmt.Sprintf(" match error: %v\n", pt.Err))
+	default:
+		buf.WriteString(fmt.Sprintf(" match = %s\n", formatVal(pt.Match)))
+	}
+	for _, d := range pt.Decisions {
+		d.write(buf)
+	}
+}
+
+// DecisionTrace records the output value contributed to a named decision by a production.
+type DecisionTrace struct {
+	Name   string
+	Output ref.Val
+	Err    error
+}
+
+func (dt *DecisionTrace) write(buf *strings.Builder) {
+	if dt.Err != nil {
+		buf.WriteString(fmt.Sprintf("      decision %s error: %v\n", dt.Name, dt.Err))
+		return
+	}
+	buf.WriteString(fmt.Sprintf("      decision %s = %s\n", dt.Name, formatVal(dt.Output)))
+}
+
+// traceRule records the start of a rule evaluation within the instance trace, if enabled.
+func (ctx *ruleActivation) traceRule(trace *InstanceTrace, rule model.Rule) *RuleTrace {
+	if trace == nil {
+		return nil
+	}
+	rt := &RuleTrace{
+		Rule:         rule,
+		RuleLocation: ctx.ruleLocation(rule),
+	}
+	trace.Rules = append(trace.Rules, rt)
+	return rt
+}
+
+// traceIteration records the range bindings for an evaluation pass over the productions.
+func (rt *RuleTrace) traceIteration(bindings map[string]ref.Val) *IterationTrace {
+	if rt == nil {
+		return nil
+	}
+	it := &IterationTrace{Bindings: copyVals(bindings)}
+	rt.Iterations = append(rt.Iterations, it)
+	return it
+}
+
+// traceTerms records the term values memoized during the evaluation pass.
+func (it *IterationTrace) traceTerms(act *evaluatorActivation) {
+	if it == nil {
+		return
+	}
+	it.Terms = act.memoizedTerms()
+}
+
+// traceProduction records the start of a production evaluation.
+func (it *IterationTrace) traceProduction(p *prod) *ProductionTrace {
+	if it == nil {
+		return nil
+	}
+	pt := &ProductionTrace{
+		ID:       p.id,
+		Location: p.loc,
+	}
+	it.Productions = append(it.Productions, pt)
+	return pt
+}
+
+// traceDecision records a decision emitted by the production.
+func (pt *ProductionTrace) traceDecision(name string) *DecisionTrace {
+	if pt == nil {
+		return nil
+	}
+	dt := &DecisionTrace{Name: name}
+	pt.Decisions = append(pt.Decisions, dt)
+	return dt
+}
+
+// traceOutput returns a program which records the output and error of the given program as it
+// is evaluated by the aggregator, or the program itself if tracing is not enabled.
+func (dt *DecisionTrace) traceOutput(prg cel.Program) cel.Program {
+	if dt == nil {
+		return prg
+	}
+	return &tracedProgram{Program: prg, dt: dt}
+}
+
+// tracedProgram records the output of the wrapped program within the decision trace.
+type tracedProgram struct {
+	cel.Program
+	dt *DecisionTrace
+}
+
+// Eval implements the cel.Program interface method.
+func (prg *tracedProgram) Eval(vars interface{}) (ref.Val, *cel.EvalDetails, error) {
+	val, det, err := prg.Program.Eval(vars)
+	prg.dt.Output = val
+	prg.dt.Err = err
+	return val, det, err
+}
+
+func writeLocation(buf *strings.Builder, loc common.Location) {
+	if loc == nil || loc == common.NoLocation {
+		return
+	}
+	buf.WriteString(fmt.Sprintf(" at %d:%d", loc.Line(), loc.Column()))
+}
+
+// formatVal renders a CEL value in a CEL-like syntax with map entries sorted by key.
+func formatVal(val ref.Val) string {
+	switch v := val.(type) {
+	case nil:
+		return "<nil>"
+	case types.String:
+		return strconv.Quote(string(v))
+	case traits.Mapper:
+		var entries []string
+		it := v.Iterator()
+		for it.HasNext() == types.True {
+			key := it.Next()
+			entries = append(entries,
+				fmt.Sprintf("%s: %s", formatVal(key), formatVal(v.Get(key))))
+		}
+		sort.Strings(entries)
+		return "{" + strings.Join(entries, ", ") + "}"
+	case traits.Lister:
+		var elems []string
+		it := v.Iterator()
+		for it.HasNext() == types.True {
+			elems = append(elems, formatVal(it.Next()))
+		}
+		return "[" + strings.Join(elems, ", ") + "]"
+	default:
+		return fmt.Sprintf("%v", v.Value())
+	}
+}
+
+func sortedNames(vals map[string]ref.Val) []string {
+	names := make([]string, 0, len(vals))
+	for name := range vals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func copyVals(vals map[string]ref.Val) map[string]ref.Val {
+	cpy := make(map[string]ref.Val, len(vals))
+	for k, v := range vals {
+		cpy[k] = v
+	}
+	return cpy
+}
@@ -0,0 +1,161 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/cel-policy-templates-go/policy/model"
+
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
+	"github.com/google/cel-go/interpreter"
+)
+
+// LabelSelector returns a Selector which matches model.LabelSelector values against the labels
+// found at the given input variable path, e.g. 'resource.labels'.
+//
+// The selector matches when every expected label is present with the expected value. When the
+// labels are absent from the input, only selectors which expect no labels match.
+//
+// Selector values other than model.LabelSelector are not matched.
+func LabelSelector(labelsPath string) Selector {
+	return func(sel model.Selector, vars interpreter.Activation) bool {
+		s, ok := sel.(*model.LabelSelector)
+		if !ok {
+			return false
+		}
+		lbls, found := resolvePath(vars, labelsPath)
+		if !found {
+			return len(s.LabelValues) == 0
+		}
+		for k, v := range s.LabelValues {
+			lv, found := findLabel(lbls, k)
+			if !found || lv != v {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// ExpressionSelector returns a Selector which matches model.ExpressionSelector values against the
+// labels found at the given input variable path, e.g. 'resource.labels'.
+//
+// The supported operators are:
+//
+// - Exists: the label is present.
+// - DoesNotExist: the label is absent.
+// - In: the label is present and its value is one of the selector values.
+// - NotIn: the label is absent or its value is not one of the selector values.
+//
+// Selector values other than model.ExpressionSelector, or with an unsupported operator, are not
+// matched.
+func ExpressionSelector(labelsPath string) Selector {
+	return func(sel model.Selector, vars interpreter.Activation) bool {
+		s, ok := sel.(*model.ExpressionSelector)
+		if !ok {
+			return false
+		}
+		var lv string
+		lbls, found := resolvePath(vars, labelsPath)
+		if found {
+			lv, found = findLabel(lbls, s.Label)
+		}
+		switch s.Operator {
+		case "Exists":
+			return found
+		case "DoesNotExist":
+			return !found
+		case "In":
+			return found && containsLabelValue(s.Values, lv)
+		case "NotIn":
+			return !found || !containsLabelValue(s.Values, lv)
+		default:
+			return false
+		}
+	}
+}
+
+// resolvePath resolves a dot-separated variable path against the input activation.
+//
+// The longest prefix of the path which resolves to a variable is used, and the remaining path
+// elements are treated as map keys. For example, 'resource.labels' resolves either as a variable
+// named 'resource.labels' or as the 'labels' key within a 'resource' variable.
+func resolvePath(vars interpreter.Activation, path string) (interface{}, bool) {
+	elems := strings.Split(path, ".")
+	for i := len(elems); i > 0; i-- {
+		val, found := vars.ResolveName(strings.Join(elems[:i], "."))
+		if !found {
+			continue
+		}
+		for _, key := range elems[i:] {
+			val, found = findKey(val, key)
+			if !found {
+				return nil, false
+			}
+		}
+		return val, true
+	}
+	return nil, false
+}
+
+// findLabel returns the string value of the label within the labels map, if present.
+func findLabel(lbls interface{}, key string) (string, bool) {
+	val, found := findKey(lbls, key)
+	if !found {
+		return "", false
+	}
+	return labelString(val), true
+}
+
+// findKey returns the value associated with the key within supported map types.
+func findKey(m interface{}, key string) (interface{}, bool) {
+	switch mv := m.(type) {
+	case map[string]string:
+		val, found := mv[key]
+		return val, found
+	case map[string]interface{}:
+		val, found := mv[key]
+		return val, found
+	case traits.Mapper:
+		return mv.Find(types.String(key))
+	default:
+		return nil, false
+	}
+}
+
+// containsLabelValue returns whether the label value is equal to one of the selector values.
+func containsLabelValue(vals []interface{}, lv string) bool {
+	for _, v := range vals {
+		if labelString(v) == lv {
+			return true
+		}
+	}
+	return false
+}
+
+func labelString(val interface{}) string {
+	switch v := val.(type) {
+	case string:
+		return v
+	case ref.Val:
+		return fmt.Sprintf("%v", v.Value())
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
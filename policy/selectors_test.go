@@ -0,0 +1,301 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policy
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/cel-policy-templates-go/policy/model"
+
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/interpreter"
+)
+
+func TestSelectors(t *testing.T) {
+	flatLabels := map[string]interface{}{
+		"resource.labels": map[string]string{"env": "prod", "debug": "false"},
+	}
+	nestedLabels := map[string]interface{}{
+		"resource": map[string]interface{}{
+			"labels": map[string]interface{}{"env": "prod", "debug": false},
+		},
+	}
+	celLabels := map[string]interface{}{
+		"resource.labels": types.NewStringStringMap(types.DefaultTypeAdapter,
+			map[string]string{"env": "prod", "debug": "false"}),
+	}
+	noLabels := map[string]interface{}{}
+	tests := []struct {
+		name string
+		sel  model.Selector
+		vars []map[string]interface{}
+		want bool
+	}{
+		{
+			name: "label_match",
+			sel:  &model.LabelSelector{LabelValues: map[string]string{"env": "prod"}},
+			vars: []map[string]interface{}{flatLabels, nestedLabels, celLabels},
+			want: true,
+		},
+		{
+			name: "label_mismatch",
+			sel:  &model.LabelSelector{LabelValues: map[string]string{"env": "dev"}},
+			vars: []map[string]interface{}{flatLabels, nestedLabels, celLabels, noLabels},
+			want: false,
+		},
+		{
+			name: "label_empty",
+			sel:  &model.LabelSelector{LabelValues: map[string]string{}},
+			vars: []map[string]interface{}{flatLabels, noLabels},
+			want: true,
+		},
+		{
+			name: "expr_exists",
+			sel:  &model.ExpressionSelector{Label: "env", Operator: "Exists"},
+			vars: []map[string]interface{}{flatLabels, nestedLabels, celLabels},
+			want: true,
+		},
+		{
+			name: "expr_exists_missing",
+			sel:  &model.ExpressionSelector{Label: "trace", Operator: "Exists"},
+			vars: []map[string]interface{}{flatLabels, nestedLabels, celLabels, noLabels},
+			want: false,
+		},
+		{
+			name: "expr_does_not_exist",
+			sel:  &model.ExpressionSelector{Label: "trace", Operator: "DoesNotExist"},
+			vars: []map[string]interface{}{flatLabels, nestedLabels, celLabels, noLabels},
+			want: true,
+		},
+		{
+			name: "expr_in",
+			sel: &model.ExpressionSelector{
+				Label: "debug", Operator: "In", Values: []interface{}{"false", "justified"}},
+			vars: []map[string]interface{}{flatLabels, nestedLabels, celLabels},
+			want: true,
+		},
+		{
+			name: "expr_in_missing",
+			sel: &model.ExpressionSelector{
+				Label: "debug", Operator: "In", Values: []interface{}{"false", "justified"}},
+			vars: []map[string]interface{}{noLabels},
+			want: false,
+		},
+		{
+			name: "expr_not_in",
+			sel: &model.ExpressionSelector{
+				Label: "env", Operator: "NotIn", Values: []interface{}{"dev", "test"}},
+			vars: []map[string]interface{}{flatLabels, nestedLabels, celLabels, noLabels},
+			want: true,
+		},
+		{
+			name: "expr_not_in_present",
+			sel: &model.ExpressionSelector{
+				Label: "env", Operator: "NotIn", Values: []interface{}{"prod"}},
+			vars: []map[string]interface{}{flatLabels, nestedLabels, celLabels},
+			want: false,
+		},
+		{
+			name: "expr_unknown_operator",
+			sel:  &model.ExpressionSelector{Label: "env", Operator: "Matches"},
+			vars: []map[string]interface{}{flatLabels},
+			want: false,
+		},
+	}
+	selectors := []Selector{
+		LabelSelector("resource.labels"),
+		ExpressionSelector("resource.labels"),
+	}
+	for _, tc := range tests {
+		tst := tc
+		t.Run(tst.name, func(tt *testing.T) {
+			for _, vars := range tst.vars {
+				act, err := interpreter.NewActivation(vars)
+				if err != nil {
+					tt.Fatal(err)
+				}
+				got := false
+				for _, sel := range selectors {
+					got = got || sel(tst.sel, act)
+				}
+				if got != tst.want {
+					tt.Errorf("got %v, wanted %v for input %v", got, tst.want, vars)
+				}
+			}
+		})
+	}
+}
+
+func TestEngine_SelectAll(t *testing.T) {
+	engine, inst := newTestEngine(t, "greeting", EvaluatorDecisionLimit(4))
+	err := engine.AddInstance(inst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		labels   map[string]string
+		selected bool
+	}{
+		{labels: map[string]string{"env": "prod", "debug": "false"}, selected: true},
+		{labels: map[string]string{"env": "prod", "debug": "justified"}, selected: true},
+		{labels: map[string]string{"env": "prod"}, selected: false},
+		{labels: map[string]string{"env": "dev", "debug": "false"}, selected: false},
+		{labels: map[string]string{"env": "prod", "debug": "false", "trace": "on"}, selected: false},
+	}
+	for _, tst := range tests {
+		decisions, err := engine.EvalAll(map[string]interface{}{"resource.labels": tst.labels})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := len(decisions) != 0; got != tst.selected {
+			t.Errorf("got selected=%v, wanted %v for labels %v", got, tst.selected, tst.labels)
+		}
+	}
+}
+
+func TestEngine_UnsupportedSelector(t *testing.T) {
+	engine, inst := newTestEngine(t, "greeting", EvaluatorDecisionLimit(4),
+		Selectors(LabelSelector("resource.labels")),
+		SupportedSelectors(&model.LabelSelector{}))
+	err := engine.AddInstance(inst)
+	if err == nil || !strings.Contains(err.Error(), "unsupported selector") {
+		t.Errorf("got %v, wanted unsupported selector error", err)
+	}
+	err = engine.ReplaceInstance(inst)
+	if err == nil || !strings.Contains(err.Error(), "unsupported selector") {
+		t.Errorf("got %v, wanted unsupported selector error", err)
+	}
+	if len(engine.instances[inst.Kind]) != 0 {
+		t.Errorf("got instances %v, wanted none", engine.instances[inst.Kind])
+	}
+
+	engine, inst = newTestEngine(t, "greeting", EvaluatorDecisionLimit(4),
+		Selectors(LabelSelector("resource.labels"), ExpressionSelector("resource.labels")),
+		SupportedSelectors(&model.LabelSelector{}, &model.ExpressionSelector{}))
+	err = engine.AddInstance(inst)
+	if err != nil {
+		t.Errorf("got %v, wanted the instance selectors to be supported", err)
+	}
+
+	// Without SupportedSelectors, the instance selectors are not checked and the Selector
+	// functions are not called until evaluation.
+	called := false
+	custom := func(model.Selector, interpreter.Activation) bool {
+		called = true
+		return false
+	}
+	engine, inst = newTestEngine(t, "greeting", EvaluatorDecisionLimit(4), Selectors(custom))
+	err = engine.AddInstance(inst)
+	if err != nil || called {
+		t.Errorf("got %v, called=%v, wanted the instance to be added unchecked", err, called)
+	}
+}
+
+func TestEngine_SelectorIndex(t *testing.T) {
+	indexed, inst := newTestEngine(t, "resource_types", SelectorIndex("resource.labels"))
+	unindexed, _ := newTestEngine(t, "resource_types")
+	insts := []*model.Instance{
+		labeledInstance(inst, "app-a", &model.LabelSelector{
+			LabelValues: map[string]string{"env": "prod", "app": "a"}}),
+		labeledInstance(inst, "app-b", &model.LabelSelector{
+			LabelValues: map[string]string{"env": "prod", "app": "b"}}),
+		labeledInstance(inst, "app-in", &model.ExpressionSelector{
+			Label: "app", Operator: "In", Values: []interface{}{"a", "c", "c"}}),
+		labeledInstance(inst, "no-trace", &model.ExpressionSelector{
+			Label: "trace", Operator: "DoesNotExist"}),
+		labeledInstance(inst, "no-selector"),
+	}
+	for _, e := range []*Engine{indexed, unindexed} {
+		for _, i := range insts {
+			err := e.AddInstance(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	inputs := []map[string]string{
+		{"env": "prod", "app": "a"},
+		{"env": "prod", "app": "b"},
+		{"env": "dev", "app": "c"},
+		{"app": "d", "trace": "true"},
+		{},
+	}
+	check := func(step string) {
+		t.Helper()
+		for _, lbls := range inputs {
+			vars := map[string]interface{}{
+				"resource.type":   "sqladmin.googleapis.com/Instance",
+				"resource.name":   "forbidden-my-sql-instance",
+				"resource.labels": lbls,
+			}
+			got, err := indexed.EvalAll(vars)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := unindexed.EvalAll(vars)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotNames := violationInstances(got)
+			wantNames := violationInstances(want)
+			if !reflect.DeepEqual(gotNames, wantNames) {
+				t.Errorf("%s: got instances %v, wanted %v for labels %v",
+					step, gotNames, wantNames, lbls)
+			}
+		}
+	}
+	check("add")
+	cands := indexed.candidateInstances("resource_types",
+		&activation{vars: map[string]interface{}{"resource.labels": map[string]string{}}})
+	if len(cands) != 2 {
+		t.Errorf("got %d candidates, wanted only the 2 unindexed instances", len(cands))
+	}
+
+	// Move app-b onto the 'c' label and remove app-a.
+	for _, e := range []*Engine{indexed, unindexed} {
+		err := e.ReplaceInstance(labeledInstance(inst, "app-b", &model.LabelSelector{
+			LabelValues: map[string]string{"app": "c"}}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.RemoveInstance("resource_types", "acme", "app-a")
+	}
+	check("update")
+}
+
+// labeledInstance returns a copy of the instance with the given name and selectors.
+func labeledInstance(inst *model.Instance, name string, sels ...model.Selector) *model.Instance {
+	cpy := *inst
+	cpy.Metadata = &model.InstanceMetadata{Namespace: "acme", Name: name}
+	cpy.Selectors = sels
+	return &cpy
+}
+
+// violationInstances returns the instance names which produced the policy violations.
+func violationInstances(decisions []model.DecisionValue) []string {
+	names := []string{}
+	for _, dv := range decisions {
+		multi, ok := dv.(model.MultiDecisionValue)
+		if !ok {
+			continue
+		}
+		for _, src := range multi.Sources() {
+			names = append(names, src.InstanceName)
+		}
+	}
+	return names
+}